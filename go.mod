@@ -2,12 +2,14 @@ module github.com/masahide/mackerel-7dtd
 
 go 1.21.5
 
-require github.com/kelseyhightower/envconfig v1.4.0
+require (
+	github.com/bwmarrin/discordgo v0.28.1
+	github.com/kelseyhightower/envconfig v1.4.0
+	github.com/mackerelio/mackerel-client-go v0.31.0
+)
 
 require (
-	github.com/bwmarrin/discordgo v0.28.1 // indirect
 	github.com/gorilla/websocket v1.4.2 // indirect
-	github.com/mackerelio/mackerel-client-go v0.31.0 // indirect
 	golang.org/x/crypto v0.0.0-20210421170649-83a5a9bb288b // indirect
 	golang.org/x/sys v0.0.0-20201119102817-f84b799fce68 // indirect
 )
@@ -2,13 +2,18 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"maps"
 	"net/http"
 	"net/http/httputil"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"time"
 
@@ -20,12 +25,33 @@ import (
 const (
 	stateDirName  = "sdtd-monitor"
 	stateFileName = "sdtd-monitor"
+
+	// maxSnapshotPlayers bounds the player snapshot kept in the state file.
+	maxSnapshotPlayers = 500
+
+	// sessionGap is how old the last snapshot may be before online sessions
+	// are considered interrupted by an agent outage.
+	sessionGap = 5 * time.Minute
+
+	// serverMetricPrefix is the namespace of server-wide metrics.
+	serverMetricPrefix = "custom.server."
 )
 
 type env struct {
-	Debug          bool   `envconfig:"DEBUG" default:"false"`
-	MackerelHostID string `envconfig:"MACKEREL_HOST_ID"`
-	MackerelAPIKey string `envconfig:"MACKEREL_API_KEY"`
+	Debug            bool          `envconfig:"DEBUG" default:"false"`
+	MackerelHostID   string        `envconfig:"MACKEREL_HOST_ID"`
+	MackerelAPIKey   string        `envconfig:"MACKEREL_API_KEY"`
+	MetricPrefix     string        `envconfig:"METRIC_PREFIX" default:"custom.player."`
+	JobTimeout       time.Duration `envconfig:"JOB_TIMEOUT" default:"50s"`
+	Sink             string        `envconfig:"SINK" default:"mackerel"` // mackerel, stdout or file
+	SinkFile         string        `envconfig:"SINK_FILE"`
+	Timezone         string        `envconfig:"TIMEZONE" default:"Local"`
+	MaxPlayers       int           `envconfig:"MAX_PLAYERS" default:"0"`    // 0 disables slots_free
+	WarmupTimeout    time.Duration `envconfig:"WARMUP_TIMEOUT" default:"0"` // wait for the server before the job, 0 disables
+	PlatformPrefixes []string      `envconfig:"PLATFORM_PREFIXES" default:"Steam_,EOS_,XBL_,PSN_"`
+	CheckName        string        `envconfig:"CHECK_NAME"` // check monitor name, empty disables
+	CheckMaxAttempts uint          `envconfig:"CHECK_MAX_ATTEMPTS" default:"3"`
+	BloodMoonCycle   int           `envconfig:"BLOOD_MOON_CYCLE" default:"0"` // 0 reads BloodMoonFrequency from the server
 	telnet.Env
 	// PlayersAPIURL    string `envconfig:"PLAYERS_API_URL" default:""`
 	// PlayersAPISecret string `envconfig:"PLAYERS_API_SECRET" default:""`
@@ -81,12 +107,77 @@ type Position struct {
 }
 */
 
+// mackerelClient is the subset of *mackerel.Client used by the agent, so a
+// fake can be injected in place of the real API.
+type mackerelClient interface {
+	PostHostMetricValuesByHostID(hostID string, metricValues []*mackerel.MetricValue) error
+	PostCheckReports(checkReports *mackerel.CheckReports) error
+}
+
+// agentState is persisted to the state file between runs.
+type agentState struct {
+	SteamIDs  []string    `json:"steamIDs"`
+	GraphDefs []MetricDef `json:"graphDefs"` // graph defs already posted to Mackerel for the current roster
+	// Players is the player list of the last run, for computing deltas
+	// across agent restarts.
+	Players    []telnet.Player `json:"players"`
+	SnapshotAt time.Time       `json:"snapshotAt"`
+	// DailyIDs are the ids seen on Day (YYYY-MM-DD in the server timezone).
+	Day      string   `json:"day"`
+	DailyIDs []string `json:"dailyIds"`
+	// FirstSeen is when each online id's session started (unix seconds).
+	FirstSeen map[string]int64 `json:"firstSeen"`
+	// BloodMoonCycle is the server's BloodMoonFrequency, 0 until read.
+	BloodMoonCycle int `json:"bloodMoonCycle"`
+}
+
+// jsonLinesSink writes metric values as JSON lines instead of posting them,
+// for checking the metric pipeline without a Mackerel account.
+type jsonLinesSink struct {
+	w io.Writer
+}
+
+func (s *jsonLinesSink) PostHostMetricValuesByHostID(hostID string, metricValues []*mackerel.MetricValue) error {
+	enc := json.NewEncoder(s.w)
+	for _, v := range metricValues {
+		if err := enc.Encode(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *jsonLinesSink) PostCheckReports(checkReports *mackerel.CheckReports) error {
+	return json.NewEncoder(s.w).Encode(checkReports)
+}
+
+// newSink returns the metric destination selected by SINK.
+func newSink(e env) (mackerelClient, error) {
+	switch e.Sink {
+	case "mackerel":
+		return mackerel.NewClient(e.MackerelAPIKey), nil
+	case "stdout":
+		return &jsonLinesSink{os.Stdout}, nil
+	case "file":
+		if e.SinkFile == "" {
+			return nil, fmt.Errorf("SINK_FILE is required for SINK=file")
+		}
+		f, err := os.OpenFile(e.SinkFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, err
+		}
+		return &jsonLinesSink{f}, nil
+	}
+	return nil, fmt.Errorf("unknown SINK: %s", e.Sink)
+}
+
 type mackerelAPI struct {
 	env
-	mkr       *mackerel.Client
-	steamIDs  []string
+	mkr       mackerelClient
+	state     agentState
 	stateFile string
 	t         *telnet.Telnet7days
+	loc       *time.Location // server timezone for daily counters
 }
 
 func jsonDump(v any) string {
@@ -156,43 +247,81 @@ func (m *mackerelAPI) getPlayersOnline() []Player {
 }
 */
 
-func trimSteam(steamID string) string {
-	return strings.TrimPrefix(steamID, "Steam_")
+// trimPlatformPrefix strips a PLATFORM_PREFIXES prefix from a player id. Ids
+// with an unknown prefix are returned unchanged.
+func (m *mackerelAPI) trimPlatformPrefix(id string) string {
+	for _, prefix := range m.PlatformPrefixes {
+		if strings.HasPrefix(id, prefix) {
+			return strings.TrimPrefix(id, prefix)
+		}
+	}
+	return id
 }
 
 func (m *mackerelAPI) createMetrics(players []telnet.Player, now time.Time) []*mackerel.MetricValue {
 	res := make([]*mackerel.MetricValue, 0, len(players)*4)
 	for _, player := range players {
-		id := trimSteam(player.PltfmID)
+		id := m.trimPlatformPrefix(player.PltfmID)
 		res = append(res, &mackerel.MetricValue{
-			Name:  "custom.player.level." + id,
+			Name:  m.MetricPrefix + "level." + id,
 			Time:  now.Unix(),
 			Value: player.Level,
 		})
+		if !m.inBounds(player) {
+			log.Printf("Dropping out-of-bounds position of %s: %+v", id, player.Position)
+			continue
+		}
 		res = append(res, &mackerel.MetricValue{
-			Name:  "custom.player.x." + id,
+			Name:  m.MetricPrefix + "x." + id,
 			Time:  now.Unix(),
 			Value: player.Position.X,
 		})
 		res = append(res, &mackerel.MetricValue{
-			Name:  "custom.player.y." + id,
+			Name:  m.MetricPrefix + "y." + id,
 			Time:  now.Unix(),
 			Value: player.Position.Y,
 		})
 		/*
 			res = append(res, &mackerel.MetricValue{
-				Name:  "custom.player.totalplaytime." + id,
+				Name:  m.MetricPrefix + "totalplaytime." + id,
 				Time:  now.Unix(),
 				Value: float64(player.TotalPlayTime),
 			})
 		*/
 	}
+	if avg, ok := averagePing(players); ok {
+		res = append(res, &mackerel.MetricValue{
+			Name:  serverMetricPrefix + "avg_ping",
+			Time:  now.Unix(),
+			Value: avg,
+		})
+	}
 	return res
 }
 
-func (m *mackerelAPI) postGraphDef(data []MetricDef) {
+// inBounds reports whether the player's position is inside the world, see
+// telnet.Env.InWorld.
+func (m *mackerelAPI) inBounds(player telnet.Player) bool {
+	p := player.Position
+	return m.InWorld(p.X, p.Y, p.Z)
+}
+
+// averagePing returns the mean ping of the online players. ok is false when
+// nobody is online.
+func averagePing(players []telnet.Player) (avg float64, ok bool) {
+	if len(players) == 0 {
+		return 0, false
+	}
+	sum := 0
+	for _, player := range players {
+		sum += player.Ping
+	}
+	return float64(sum) / float64(len(players)), true
+}
+
+func (m *mackerelAPI) postGraphDef(ctx context.Context, data []MetricDef) error {
 	url := "https://api.mackerelio.com/api/v0/graph-defs/create"
-	m.post(url, data)
+	return m.post(ctx, url, data)
 }
 
 /*
@@ -202,19 +331,21 @@ func (m *mackerelAPI) postMetrics(data []MetricValue) {
 }
 */
 
-func (m *mackerelAPI) post(url string, data any) {
+// post sends data as JSON to the Mackerel API. In debug mode the request is
+// only logged.
+func (m *mackerelAPI) post(ctx context.Context, url string, data any) error {
 	jsonData, err := json.Marshal(data)
 	if err != nil {
-		log.Fatalf("Error marshaling metrics: %v", err)
+		return fmt.Errorf("Error marshaling metrics: %v", err)
 	}
 	if m.Debug {
 		log.Printf("Posting metrics to url:%s: %s", url, jsonData)
-		return
+		return nil
 	}
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonData))
 	if err != nil {
-		log.Fatalf("Error creating request: %v", err)
+		return fmt.Errorf("Error creating request: %v", err)
 	}
 
 	req.Header.Set("Content-Type", "application/json")
@@ -222,25 +353,29 @@ func (m *mackerelAPI) post(url string, data any) {
 
 	client := &http.Client{}
 	resp, err := client.Do(req)
+	if err != nil && ctx.Err() != nil {
+		return fmt.Errorf("Posting to %s cancelled: %w", url, ctx.Err())
+	}
 	if err != nil {
 		log.Printf("REQUEST:\n%s", reqDump(req))
-		log.Fatalf("Error posting metrics to Mackerel: %v", err)
+		return fmt.Errorf("Error posting metrics to Mackerel: %v", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
 		log.Printf("REQUEST:\n%s", reqDump(req))
 		log.Printf("RESPONSE:\n%s", respDump(resp))
-		log.Fatalf("Received non-200 response: %d", resp.StatusCode)
+		return fmt.Errorf("Received non-200 response: %d", resp.StatusCode)
 	}
 
 	log.Println("Metrics posted successfully")
+	return nil
 }
 
-func getSteamIDs(players []telnet.Player) []string {
+func (m *mackerelAPI) getSteamIDs(players []telnet.Player) []string {
 	ids := make([]string, len(players))
 	for i, player := range players {
-		ids[i] = trimSteam(player.PltfmID)
+		ids[i] = m.trimPlatformPrefix(player.PltfmID)
 	}
 	return ids
 }
@@ -257,62 +392,137 @@ func compeareSteamIDs(steamIDs1, steamIDs2 []string) bool {
 	return true
 }
 
-func makeDef(players []telnet.Player) []MetricDef {
-	metricDefs := make([]MetricDef, 0, len(players)*4)
+// normalizeDisplayName folds a player name for collision detection.
+func normalizeDisplayName(name string) string {
+	return strings.ToLower(strings.TrimSpace(name))
+}
+
+// displayNames maps each player id to its graph legend name. Players sharing
+// a name get an id suffix, at least 4 characters long and grown until it
+// tells them apart.
+func (m *mackerelAPI) displayNames(players []telnet.Player) map[string]string {
+	groups := map[string][]string{}
+	for _, player := range players {
+		key := normalizeDisplayName(player.Name)
+		groups[key] = append(groups[key], m.trimPlatformPrefix(player.PltfmID))
+	}
+	names := make(map[string]string, len(players))
+	for _, player := range players {
+		id := m.trimPlatformPrefix(player.PltfmID)
+		name := player.Name
+		if ids := groups[normalizeDisplayName(name)]; len(ids) > 1 {
+			name = fmt.Sprintf("%s (%s)", name, idSuffix(id, suffixLen(ids)))
+		}
+		names[id] = name
+	}
+	return names
+}
+
+// suffixLen returns the shortest suffix length, at least 4, that is unique
+// across ids.
+func suffixLen(ids []string) int {
+	longest := 0
+	for _, id := range ids {
+		longest = max(longest, len(id))
+	}
+	for n := 4; n < longest; n++ {
+		seen := map[string]bool{}
+		unique := true
+		for _, id := range ids {
+			suffix := idSuffix(id, n)
+			if seen[suffix] {
+				unique = false
+				break
+			}
+			seen[suffix] = true
+		}
+		if unique {
+			return n
+		}
+	}
+	return longest
+}
+
+// idSuffix returns the last n characters of id.
+func idSuffix(id string, n int) string {
+	if len(id) > n {
+		return id[len(id)-n:]
+	}
+	return id
+}
+
+func (m *mackerelAPI) makeDef(players []telnet.Player) []MetricDef {
+	prefix := m.MetricPrefix
+	metricDefs := make([]MetricDef, 0, len(players)*5)
+	names := m.displayNames(players)
 	for _, player := range players {
-		id := trimSteam(player.PltfmID)
+		id := m.trimPlatformPrefix(player.PltfmID)
 		metricDefs = append(metricDefs, MetricDef{
-			Name:        "custom.player.level",
+			Name:        prefix + "level",
 			DisplayName: "レベル",
 			Unit:        "integer",
 			// "float", "integer", "percentage", "seconds", "milliseconds",
 			//"bytes", "bytes/sec", "bits/sec", "iops"
 			Metrics: []MetricDetail{
 				{
-					Name:        "custom.player.level." + id,
-					DisplayName: player.Name,
+					Name:        prefix + "level." + id,
+					DisplayName: names[id],
 					IsStacked:   false,
 				},
 			},
 		})
 		metricDefs = append(metricDefs, MetricDef{
-			Name:        "custom.player.x",
+			Name:        prefix + "x",
 			DisplayName: "位置X",
 			Unit:        "float",
 			// "float", "integer", "percentage", "seconds", "milliseconds",
 			//"bytes", "bytes/sec", "bits/sec", "iops"
 			Metrics: []MetricDetail{
 				{
-					Name:        "custom.player.x." + id,
-					DisplayName: player.Name,
+					Name:        prefix + "x." + id,
+					DisplayName: names[id],
 					IsStacked:   false,
 				},
 			},
 		})
 		metricDefs = append(metricDefs, MetricDef{
-			Name:        "custom.player.y",
+			Name:        prefix + "y",
 			DisplayName: "位置Y",
 			Unit:        "float",
 			// "float", "integer", "percentage", "seconds", "milliseconds",
 			//"bytes", "bytes/sec", "bits/sec", "iops"
 			Metrics: []MetricDetail{
 				{
-					Name:        "custom.player.y." + id,
-					DisplayName: player.Name,
+					Name:        prefix + "y." + id,
+					DisplayName: names[id],
+					IsStacked:   false,
+				},
+			},
+		})
+		metricDefs = append(metricDefs, MetricDef{
+			Name:        prefix + "session_seconds",
+			DisplayName: "セッション時間",
+			Unit:        "seconds",
+			// "float", "integer", "percentage", "seconds", "milliseconds",
+			//"bytes", "bytes/sec", "bits/sec", "iops"
+			Metrics: []MetricDetail{
+				{
+					Name:        prefix + "session_seconds." + id,
+					DisplayName: names[id],
 					IsStacked:   false,
 				},
 			},
 		})
 		metricDefs = append(metricDefs, MetricDef{
-			Name:        "custom.player.totalplaytime",
+			Name:        prefix + "totalplaytime",
 			DisplayName: "プレイ時間",
 			Unit:        "seconds",
 			// "float", "integer", "percentage", "seconds", "milliseconds",
 			//"bytes", "bytes/sec", "bits/sec", "iops"
 			Metrics: []MetricDetail{
 				{
-					Name:        "custom.player.totalplaytime." + id,
-					DisplayName: player.Name,
+					Name:        prefix + "totalplaytime." + id,
+					DisplayName: names[id],
 					IsStacked:   false,
 				},
 			},
@@ -321,33 +531,311 @@ func makeDef(players []telnet.Player) []MetricDef {
 	return metricDefs
 }
 
+// defKey identifies a MetricDef by its name and metric names.
+func defKey(def MetricDef) string {
+	key := def.Name
+	for _, metric := range def.Metrics {
+		key += "/" + metric.Name
+	}
+	return key
+}
+
+// diffDefs returns the defs that are new or differ from the posted ones.
+func diffDefs(posted, defs []MetricDef) []MetricDef {
+	known := make(map[string]string, len(posted))
+	for _, def := range posted {
+		known[defKey(def)] = jsonDump(def)
+	}
+	res := []MetricDef{}
+	for _, def := range defs {
+		if known[defKey(def)] != jsonDump(def) {
+			res = append(res, def)
+		}
+	}
+	return res
+}
+
+// mergeDefs returns posted updated with defs, replacing entries with the
+// same key.
+func mergeDefs(posted, defs []MetricDef) []MetricDef {
+	index := make(map[string]int, len(posted))
+	res := append([]MetricDef{}, posted...)
+	for i, def := range res {
+		index[defKey(def)] = i
+	}
+	for _, def := range defs {
+		if i, ok := index[defKey(def)]; ok {
+			res[i] = def
+			continue
+		}
+		index[defKey(def)] = len(res)
+		res = append(res, def)
+	}
+	return res
+}
+
+// pruneDefs returns the posted defs whose key is in current, so the state
+// only holds the defs of the players online at the last roster change.
+func pruneDefs(posted, current []MetricDef) []MetricDef {
+	keep := make(map[string]bool, len(current))
+	for _, def := range current {
+		keep[defKey(def)] = true
+	}
+	res := []MetricDef{}
+	for _, def := range posted {
+		if keep[defKey(def)] {
+			res = append(res, def)
+		}
+	}
+	return res
+}
+
+// postMetrics posts metrics to Mackerel, giving up when ctx is done. The
+// Mackerel client has no context support, so an abandoned post finishes in
+// the background.
+func (m *mackerelAPI) postMetrics(ctx context.Context, metrics []*mackerel.MetricValue) error {
+	errc := make(chan error, 1)
+	go func() {
+		errc <- m.mkr.PostHostMetricValuesByHostID(m.MackerelHostID, metrics)
+	}()
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// countDaily adds ids to the set of players seen today, resetting it at
+// midnight in the server timezone, and returns the size of the set.
+func (m *mackerelAPI) countDaily(ids []string, now time.Time) int {
+	day := now.In(m.loc).Format("2006-01-02")
+	if m.state.Day != day {
+		m.state.Day = day
+		m.state.DailyIDs = []string{}
+	}
+	for _, id := range ids {
+		if !slices.Contains(m.state.DailyIDs, id) {
+			m.state.DailyIDs = append(m.state.DailyIDs, id)
+		}
+	}
+	return len(m.state.DailyIDs)
+}
+
+// trackSessions records when each online id was first seen and returns the
+// current session length in seconds per id. Ids that went offline are
+// forgotten, unless the player list is partial. If the previous snapshot is
+// older than sessionGap the agent wasn't running, so everyone starts a fresh
+// session.
+func (m *mackerelAPI) trackSessions(ids []string, partial bool, now time.Time) map[string]int64 {
+	if m.state.FirstSeen == nil || now.Sub(m.state.SnapshotAt) > sessionGap {
+		m.state.FirstSeen = map[string]int64{}
+	}
+	online := make(map[string]int64, len(ids))
+	for _, id := range ids {
+		first, ok := m.state.FirstSeen[id]
+		if !ok {
+			first = now.Unix()
+		}
+		online[id] = first
+	}
+	if partial {
+		maps.Copy(m.state.FirstSeen, online)
+	} else {
+		m.state.FirstSeen = online
+	}
+	sessions := make(map[string]int64, len(online))
+	for id, first := range online {
+		sessions[id] = now.Unix() - first
+	}
+	return sessions
+}
+
+// bloodMoonCountdown returns the game days until the next blood moon.
+func (m *mackerelAPI) bloodMoonCountdown(ctx context.Context) (int, error) {
+	day, err := m.t.GetTimeContext(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return day.DaysUntilBloodMoon(m.bloodMoonCycle(ctx)), nil
+}
+
+// bloodMoonCycle returns BLOOD_MOON_CYCLE, or the server's BloodMoonFrequency
+// when unset. The server value is cached in the state file; a failed lookup
+// falls back to the default and is retried on the next run.
+func (m *mackerelAPI) bloodMoonCycle(ctx context.Context) int {
+	if m.BloodMoonCycle > 0 {
+		return m.BloodMoonCycle
+	}
+	if m.state.BloodMoonCycle > 0 {
+		return m.state.BloodMoonCycle
+	}
+	cycle, err := m.t.GetBloodMoonCycleContext(ctx)
+	if err != nil {
+		log.Printf("Error getting BloodMoonFrequency, assuming %d: %s", telnet.DefaultBloodMoonCycle, err)
+		return telnet.DefaultBloodMoonCycle
+	}
+	m.state.BloodMoonCycle = cycle
+	return cycle
+}
+
+// reportCheck posts the server's reachability to the CHECK_NAME check
+// monitor: CRITICAL with the error when the server couldn't be queried, OK
+// otherwise. Mackerel alerts after CHECK_MAX_ATTEMPTS consecutive failures.
+// A failed submission is only logged.
+func (m *mackerelAPI) reportCheck(probeErr error) {
+	if m.CheckName == "" {
+		return
+	}
+	report := &mackerel.CheckReport{
+		Source:           mackerel.NewCheckSourceHost(m.MackerelHostID),
+		Name:             m.CheckName,
+		Status:           mackerel.CheckStatusOK,
+		Message:          "server is reachable",
+		OccurredAt:       time.Now().Unix(),
+		MaxCheckAttempts: m.CheckMaxAttempts,
+	}
+	if probeErr != nil {
+		report.Status = mackerel.CheckStatusCritical
+		report.Message = probeErr.Error()
+	}
+	reports := &mackerel.CheckReports{Reports: []*mackerel.CheckReport{report}}
+	if m.Debug {
+		log.Println(jsonDump(reports))
+		return
+	}
+	if err := m.mkr.PostCheckReports(reports); err != nil {
+		log.Printf("Error posting check report: %s", err)
+	}
+}
+
+// serverDefs returns the graph def of the server-wide metrics. They share
+// the custom.server graph, whose unit is float since fps is fractional.
+func serverDefs() []MetricDef {
+	return []MetricDef{{
+		Name:        strings.TrimSuffix(serverMetricPrefix, "."),
+		DisplayName: "サーバー",
+		Unit:        "float",
+		Metrics: []MetricDetail{
+			{Name: serverMetricPrefix + "hostiles", DisplayName: "ゾンビ"},
+			{Name: serverMetricPrefix + "entities", DisplayName: "エンティティ"},
+			{Name: serverMetricPrefix + "fps", DisplayName: "FPS"},
+			{Name: serverMetricPrefix + "bloodmoon_countdown", DisplayName: "ブラッドムーンまでの日数"},
+			{Name: serverMetricPrefix + "slots_free", DisplayName: "空きスロット"},
+			{Name: serverMetricPrefix + "unique_players_today", DisplayName: "本日のプレイヤー数"},
+			{Name: serverMetricPrefix + "avg_ping", DisplayName: "平均Ping"},
+		},
+	}}
+}
+
 func (m *mackerelAPI) job() {
+	ctx, cancel := context.WithTimeout(context.Background(), m.JobTimeout)
+	defer cancel()
 
-	players, err := m.t.GetPlayers()
+	players, err := m.t.GetPlayersContext(ctx)
+	partial := errors.Is(err, telnet.ErrPartialPlayers)
+	if partial {
+		m.reportCheck(nil)
+	} else {
+		m.reportCheck(err)
+	}
 	if err != nil {
 		log.Printf("Error getting players: %s", err)
-		return
+		if !partial {
+			return
+		}
 	}
-	ids := getSteamIDs(players)
-	if len(ids) == 0 {
-		if m.Debug {
-			log.Println("No players online")
+	// m.state.Players still holds the previous snapshot until the job ends.
+	if !partial {
+		defer m.saveSnapshot(players)
+	}
+	ids := m.getSteamIDs(players)
+	now := time.Now()
+	sessions := m.trackSessions(ids, partial, now)
+	// With nobody online there are no player metrics, but the server-wide
+	// ones are still posted.
+	if len(ids) == 0 && m.Debug {
+		log.Println("No players online")
+	}
+	// A truncated list would look like a roster change, so only post the
+	// metrics we got and leave the graph defs and state alone. The defs are
+	// only recorded once Mackerel accepted them, so a failed or debug run
+	// posts them again next time. The server defs are posted on the first
+	// run even if the server is empty.
+	rosterChanged := !compeareSteamIDs(m.state.SteamIDs, ids) || len(m.state.GraphDefs) == 0
+	if !partial && rosterChanged && m.Sink == "mackerel" {
+		current := append(m.makeDef(players), serverDefs()...)
+		defs := diffDefs(m.state.GraphDefs, current)
+		if len(defs) == 0 {
+			m.state.GraphDefs = pruneDefs(m.state.GraphDefs, current)
+			m.state.SteamIDs = ids
+		} else if err := m.postGraphDef(ctx, defs); err != nil {
+			log.Printf("Error posting graph defs: %s", err)
+		} else if !m.Debug {
+			m.state.GraphDefs = pruneDefs(mergeDefs(m.state.GraphDefs, defs), current)
+			m.state.SteamIDs = ids
 		}
-		return
 	}
-	if !compeareSteamIDs(m.steamIDs, ids) {
-		m.postGraphDef(makeDef(players))
-		m.steamIDs = ids
-		if err := saveState(m.stateFile, m.steamIDs); err != nil {
-			log.Println(err)
+	metrics := m.createMetrics(players, now)
+	if mem, err := m.t.GetMemContext(ctx); err != nil {
+		log.Printf("Skipping mem metrics: %s", err)
+	} else {
+		metrics = append(metrics, &mackerel.MetricValue{
+			Name:  serverMetricPrefix + "hostiles",
+			Time:  now.Unix(),
+			Value: mem.Zombies,
+		}, &mackerel.MetricValue{
+			Name:  serverMetricPrefix + "entities",
+			Time:  now.Unix(),
+			Value: mem.Entities,
+		})
+		// Some server versions don't report fps in mem.
+		if mem.FPS != nil {
+			metrics = append(metrics, &mackerel.MetricValue{
+				Name:  serverMetricPrefix + "fps",
+				Time:  now.Unix(),
+				Value: *mem.FPS,
+			})
 		}
 	}
-	metrics := m.createMetrics(players, time.Now())
+	if days, err := m.bloodMoonCountdown(ctx); err != nil {
+		log.Printf("Skipping blood moon countdown metric: %s", err)
+	} else {
+		metrics = append(metrics, &mackerel.MetricValue{
+			Name:  serverMetricPrefix + "bloodmoon_countdown",
+			Time:  now.Unix(),
+			Value: days,
+		})
+	}
+	// A truncated list would overstate the free slots.
+	if m.MaxPlayers > 0 && !partial {
+		metrics = append(metrics, &mackerel.MetricValue{
+			Name:  serverMetricPrefix + "slots_free",
+			Time:  now.Unix(),
+			Value: max(m.MaxPlayers-len(players), 0),
+		})
+	}
+	for id, seconds := range sessions {
+		metrics = append(metrics, &mackerel.MetricValue{
+			Name:  m.MetricPrefix + "session_seconds." + id,
+			Time:  now.Unix(),
+			Value: seconds,
+		})
+	}
+	metrics = append(metrics, &mackerel.MetricValue{
+		Name:  serverMetricPrefix + "unique_players_today",
+		Time:  now.Unix(),
+		Value: m.countDaily(ids, now),
+	})
 	if m.Debug {
 		log.Println(jsonDump(metrics))
 		return
 	}
-	err = m.mkr.PostHostMetricValuesByHostID(m.MackerelHostID, metrics)
+	err = m.postMetrics(ctx, metrics)
+	if errors.Is(err, context.DeadlineExceeded) {
+		log.Printf("Job timed out after %s", m.JobTimeout)
+		return
+	}
 	if err != nil {
 		log.Println(err)
 	}
@@ -360,13 +848,36 @@ func readState(file string, v any) error {
 	defer f.Close()
 	return json.NewDecoder(f).Decode(v)
 }
+
+// saveState writes v as JSON to a temporary file and renames it over file,
+// so a crash never leaves a truncated state file.
 func saveState(file string, v any) error {
-	f, err := os.Create(file)
+	f, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".tmp*")
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-	return json.NewEncoder(f).Encode(v)
+	defer os.Remove(f.Name())
+	if err := json.NewEncoder(f).Encode(v); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), file)
+}
+
+// saveSnapshot persists players as the latest snapshot, keeping at most
+// maxSnapshotPlayers entries to bound the state file size.
+func (m *mackerelAPI) saveSnapshot(players []telnet.Player) {
+	if len(players) > maxSnapshotPlayers {
+		players = players[:maxSnapshotPlayers]
+	}
+	m.state.Players = players
+	m.state.SnapshotAt = time.Now()
+	if err := saveState(m.stateFile, m.state); err != nil {
+		log.Println(err)
+	}
 }
 
 func main() {
@@ -375,20 +886,49 @@ func main() {
 	if err := envconfig.Process("", &e); err != nil {
 		log.Fatal(err)
 	}
+	// Mackerel only accepts custom metrics under "custom."
+	if !strings.HasPrefix(e.MetricPrefix, "custom.") {
+		log.Fatalf("METRIC_PREFIX must start with \"custom.\": %s", e.MetricPrefix)
+	}
+	if !strings.HasSuffix(e.MetricPrefix, ".") {
+		e.MetricPrefix += "."
+	}
 	tmpDir := os.TempDir()
 	uid := os.Getuid()
 	dir := filepath.Join(tmpDir, fmt.Sprintf("%s_%d", stateDirName, uid))
 	fpath := filepath.Join(dir, stateFileName)
-	m := &mackerelAPI{e, mackerel.NewClient(e.MackerelAPIKey), []string{}, fpath,
-		&telnet.Telnet7days{
+	sink, err := newSink(e)
+	if err != nil {
+		log.Fatal(err)
+	}
+	loc, err := time.LoadLocation(e.Timezone)
+	if err != nil {
+		log.Fatalf("Invalid TIMEZONE: %v", err)
+	}
+	m := &mackerelAPI{
+		env:       e,
+		mkr:       sink,
+		state:     agentState{SteamIDs: []string{}},
+		stateFile: fpath,
+		t: &telnet.Telnet7days{
 			Env: e.Env,
 		},
+		loc: loc,
 	}
 	os.MkdirAll(dir, 0755)
-	if err := readState(fpath, &m.steamIDs); err != nil {
-		m.steamIDs = []string{}
-		saveState(fpath, m.steamIDs)
+	if err := readState(fpath, &m.state); err != nil {
+		m.state = agentState{SteamIDs: []string{}}
+		saveState(fpath, m.state)
 		log.Printf("Create State file: %s", fpath)
 	}
+	if e.WarmupTimeout > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), e.WarmupTimeout)
+		err := m.t.WaitReady(ctx, 10*time.Second)
+		cancel()
+		if err != nil {
+			log.Fatalf("Server not reachable: %v", err)
+		}
+		log.Printf("Server %s is reachable", e.ServerAddr)
+	}
 	m.job()
 }
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mackerelio/mackerel-client-go"
+	"github.com/masahide/mackerel-7dtd/pkg/telnet"
+	"github.com/masahide/mackerel-7dtd/pkg/telnet/telnettest"
+)
+
+// fakeMackerel records what the agent posts instead of calling the API.
+type fakeMackerel struct {
+	hostID  string
+	metrics []*mackerel.MetricValue
+	checks  []*mackerel.CheckReport
+}
+
+func (f *fakeMackerel) PostHostMetricValuesByHostID(hostID string, metricValues []*mackerel.MetricValue) error {
+	f.hostID = hostID
+	f.metrics = append(f.metrics, metricValues...)
+	return nil
+}
+
+func (f *fakeMackerel) PostCheckReports(checkReports *mackerel.CheckReports) error {
+	f.checks = append(f.checks, checkReports.Reports...)
+	return nil
+}
+
+// values returns the posted metric values by name.
+func (f *fakeMackerel) values() map[string]any {
+	res := map[string]any{}
+	for _, v := range f.metrics {
+		res[v.Name] = v.Value
+	}
+	return res
+}
+
+func newTestAPI(t *testing.T, mkr mackerelClient, addr string) *mackerelAPI {
+	t.Helper()
+	return &mackerelAPI{
+		env: env{
+			MackerelHostID:   "host1",
+			MetricPrefix:     "custom.player.",
+			JobTimeout:       10 * time.Second,
+			Sink:             "file",
+			PlatformPrefixes: []string{"Steam_", "EOS_"},
+			CheckName:        "7dtd",
+			BloodMoonCycle:   7,
+		},
+		mkr:       mkr,
+		state:     agentState{SteamIDs: []string{}},
+		stateFile: filepath.Join(t.TempDir(), stateFileName),
+		t: &telnet.Telnet7days{Env: telnet.Env{
+			ServerAddr:          addr,
+			TelnetPass:          "secret",
+			TelnetPromptMarkers: []string{"password"},
+		}},
+		loc: time.UTC,
+	}
+}
+
+func TestCreateMetrics(t *testing.T) {
+	m := newTestAPI(t, &fakeMackerel{}, "")
+	players := make([]telnet.Player, 2)
+	players[0].PltfmID = "Steam_76561198000000001"
+	players[0].Level = 12
+	players[0].Position.X = -1234.5
+	players[0].Position.Y = 61
+	players[0].Ping = 20
+	players[1].PltfmID = "EOS_0002"
+	players[1].Level = 3
+	players[1].Position.X = 99999 // out of bounds
+	players[1].Ping = 40
+	now := time.Unix(1719741370, 0)
+
+	got := map[string]any{}
+	for _, v := range m.createMetrics(players, now) {
+		if v.Time != now.Unix() {
+			t.Errorf("%s: time = %d, want %d", v.Name, v.Time, now.Unix())
+		}
+		got[v.Name] = v.Value
+	}
+	want := map[string]any{
+		"custom.player.level.76561198000000001": 12,
+		"custom.player.x.76561198000000001":     -1234.5,
+		"custom.player.y.76561198000000001":     61.0,
+		"custom.player.level.0002":              3,
+		"custom.server.avg_ping":                30.0,
+	}
+	if len(got) != len(want) {
+		t.Errorf("got %d metrics %v, want %d", len(got), got, len(want))
+	}
+	for name, value := range want {
+		if got[name] != value {
+			t.Errorf("%s = %v, want %v", name, got[name], value)
+		}
+	}
+}
+
+func TestAveragePing(t *testing.T) {
+	tests := []struct {
+		pings  []int
+		avg    float64
+		wantOK bool
+	}{
+		{nil, 0, false},
+		{[]int{}, 0, false},
+		{[]int{20}, 20, true},
+		{[]int{20, 45}, 32.5, true},
+		{[]int{0, 0, 30}, 10, true},
+	}
+	for _, tt := range tests {
+		players := make([]telnet.Player, len(tt.pings))
+		for i, ping := range tt.pings {
+			players[i].Ping = ping
+		}
+		avg, ok := averagePing(players)
+		if avg != tt.avg || ok != tt.wantOK {
+			t.Errorf("%v: got %v, %v, want %v, %v", tt.pings, avg, ok, tt.avg, tt.wantOK)
+		}
+	}
+}
+
+func TestTrimPlatformPrefix(t *testing.T) {
+	m := newTestAPI(t, &fakeMackerel{}, "")
+	m.PlatformPrefixes = []string{"Steam_", "EOS_", "XBL_", "PSN_"}
+	tests := []struct {
+		id   string
+		want string
+	}{
+		{"Steam_76561198000000001", "76561198000000001"},
+		{"EOS_0002abcdef0002abcdef0002abcdef", "0002abcdef0002abcdef0002abcdef"},
+		{"XBL_2535400000000000", "2535400000000000"},
+		{"NSW_1234", "NSW_1234"},
+		{"76561198000000001", "76561198000000001"},
+		{"Steam_EOS_1", "EOS_1"},
+	}
+	for _, tt := range tests {
+		if got := m.trimPlatformPrefix(tt.id); got != tt.want {
+			t.Errorf("%q: got %q, want %q", tt.id, got, tt.want)
+		}
+	}
+
+	m.PlatformPrefixes = []string{"Steam_"}
+	if got := m.trimPlatformPrefix("EOS_0002"); got != "EOS_0002" {
+		t.Errorf("EOS_0002 with only Steam_ configured: got %q", got)
+	}
+}
+
+func TestDisplayNames(t *testing.T) {
+	m := newTestAPI(t, &fakeMackerel{}, "")
+	var players []telnet.Player
+	for _, p := range []struct{ name, id string }{
+		// The last 4 characters of the first two ids are the same.
+		{"Alice", "Steam_76561198000001234"},
+		{"alice ", "Steam_76561198000091234"},
+		{"ALICE", "EOS_0000000000000000000000000005678"},
+		{"Carol", "Steam_76561198000004321"},
+	} {
+		players = append(players, telnet.Player{Name: p.name, PltfmID: p.id})
+	}
+	want := map[string]string{
+		"76561198000001234":               "Alice (01234)",
+		"76561198000091234":               "alice  (91234)",
+		"0000000000000000000000000005678": "ALICE (05678)",
+		"76561198000004321":               "Carol",
+	}
+	got := m.displayNames(players)
+	if len(got) != len(want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	for id, name := range want {
+		if got[id] != name {
+			t.Errorf("%s: got %q, want %q", id, got[id], name)
+		}
+	}
+}
+
+func TestJob(t *testing.T) {
+	server := telnettest.NewServer(t, map[string][]string{
+		"lp": {
+			"1. id=171, Alice, pos=(-1234.5, 61.0, 567.8), rot=(0.0, 90.0, 0.0), remote=True, health=100, deaths=0, zombies=10, players=0, score=10, level=5, pltfmid=Steam_76561198000000001, crossid=EOS_00000000000000000000000000000001, ip=10.0.0.2, ping=20",
+			"Total of 1 in the game",
+		},
+		"mem": {"2024-06-30T09:56:10 17457.103 INF Time: 290.77m FPS: 37.02 Heap: 2173.9MB Max: 2766.2MB Chunks: 529 CGO: 24 Ply: 1 Zom: 8 Ent: 19 (173) Items: 0 CO: 2 RSS: 5731.27MB"},
+		"gt":  {"Day 17, 15:27"},
+	})
+	mkr := &fakeMackerel{}
+	m := newTestAPI(t, mkr, server.Addr)
+	m.job()
+
+	if mkr.hostID != "host1" {
+		t.Errorf("host id = %q, want host1", mkr.hostID)
+	}
+	got := mkr.values()
+	want := map[string]any{
+		"custom.player.level.76561198000000001":           5,
+		"custom.player.x.76561198000000001":               -1234.5,
+		"custom.player.y.76561198000000001":               61.0,
+		"custom.player.session_seconds.76561198000000001": int64(0),
+		"custom.server.avg_ping":                          20.0,
+		"custom.server.hostiles":                          8,
+		"custom.server.entities":                          19,
+		"custom.server.fps":                               37.02,
+		"custom.server.bloodmoon_countdown":               4,
+		"custom.server.unique_players_today":              1,
+	}
+	for name, value := range want {
+		if got[name] != value {
+			t.Errorf("%s = %v (%T), want %v", name, got[name], got[name], value)
+		}
+	}
+	if len(mkr.checks) != 1 || mkr.checks[0].Status != mackerel.CheckStatusOK {
+		t.Errorf("check reports = %+v, want one OK report", mkr.checks)
+	}
+	if len(m.state.Players) != 1 || m.state.Players[0].Name != "Alice" {
+		t.Errorf("snapshot = %+v, want Alice", m.state.Players)
+	}
+}
+
+func TestJobServerDown(t *testing.T) {
+	server := telnettest.NewServer(t, nil)
+	server.SetDown(true)
+	mkr := &fakeMackerel{}
+	m := newTestAPI(t, mkr, server.Addr)
+	m.job()
+
+	if len(mkr.metrics) != 0 {
+		t.Errorf("posted %d metrics, want none", len(mkr.metrics))
+	}
+	if len(mkr.checks) != 1 || mkr.checks[0].Status != mackerel.CheckStatusCritical {
+		t.Errorf("check reports = %+v, want one CRITICAL report", mkr.checks)
+	}
+}
+
+func TestBloodMoonCycleFromServer(t *testing.T) {
+	server := telnettest.NewServer(t, map[string][]string{
+		"gt":          {"Day 17, 15:27"},
+		"getgamepref": {"GamePref.BloodMoonFrequency = 10", "GamePref.DayNightLength = 60"},
+	})
+	m := newTestAPI(t, &fakeMackerel{}, server.Addr)
+	m.BloodMoonCycle = 0
+	days, err := m.bloodMoonCountdown(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if days != 3 {
+		t.Errorf("countdown = %d, want 3", days)
+	}
+	if m.state.BloodMoonCycle != 10 {
+		t.Errorf("cached cycle = %d, want 10", m.state.BloodMoonCycle)
+	}
+	// The cached value is used without asking the server again.
+	m.t.ServerAddr = "127.0.0.1:1"
+	if got := m.bloodMoonCycle(context.Background()); got != 10 {
+		t.Errorf("cycle = %d, want 10", got)
+	}
+}
+
+func TestServerDefs(t *testing.T) {
+	units := map[string]string{}
+	for _, def := range serverDefs() {
+		if prev, ok := units[def.Name]; ok {
+			t.Errorf("%s defined twice, units %s and %s", def.Name, prev, def.Unit)
+		}
+		units[def.Name] = def.Unit
+		for _, metric := range def.Metrics {
+			// Mackerel groups a metric under the def named by the part
+			// before its last dot.
+			if name := metric.Name[:strings.LastIndex(metric.Name, ".")]; name != def.Name {
+				t.Errorf("%s is listed in %s but graphed in %s", metric.Name, def.Name, name)
+			}
+		}
+	}
+	want := map[string]string{
+		"custom.server": "float",
+	}
+	for name, unit := range want {
+		if units[name] != unit {
+			t.Errorf("%s unit = %q, want %q", name, units[name], unit)
+		}
+	}
+}
+
+func TestJobNoPlayers(t *testing.T) {
+	server := telnettest.NewServer(t, map[string][]string{
+		"lp":  {"Total of 0 in the game"},
+		"mem": {"2024-06-30T09:56:10 17457.103 INF Time: 290.77m FPS: 37.02 Heap: 2173.9MB Max: 2766.2MB Chunks: 529 CGO: 24 Ply: 0 Zom: 3 Ent: 7 (173) Items: 0 CO: 2 RSS: 5731.27MB"},
+		"gt":  {"Day 17, 15:27"},
+	})
+	mkr := &fakeMackerel{}
+	m := newTestAPI(t, mkr, server.Addr)
+	m.MaxPlayers = 8
+	m.job()
+
+	got := mkr.values()
+	want := map[string]any{
+		"custom.server.hostiles":   3,
+		"custom.server.entities":   7,
+		"custom.server.fps":        37.02,
+		"custom.server.slots_free": 8,
+		// nobody seen yet today
+		"custom.server.unique_players_today": 0,
+	}
+	for name, value := range want {
+		if got[name] != value {
+			t.Errorf("%s = %v (%T), want %v", name, got[name], got[name], value)
+		}
+	}
+	for name := range got {
+		if strings.HasPrefix(name, "custom.player.") {
+			t.Errorf("posted player metric %s with nobody online", name)
+		}
+	}
+}
+
+func TestCountDaily(t *testing.T) {
+	m := newTestAPI(t, &fakeMackerel{}, "")
+	jst := time.FixedZone("JST", 9*60*60)
+	m.loc = jst
+	steps := []struct {
+		at   time.Time
+		ids  []string
+		want int
+	}{
+		{time.Date(2024, 6, 30, 8, 59, 0, 0, jst), []string{"a", "b"}, 2},
+		// midnight UTC is not midnight in TIMEZONE
+		{time.Date(2024, 6, 30, 9, 0, 0, 0, jst), []string{"b", "c"}, 3},
+		{time.Date(2024, 6, 30, 23, 59, 59, 0, jst), nil, 3},
+		{time.Date(2024, 7, 1, 0, 0, 0, 0, jst), []string{"c"}, 1},
+		{time.Date(2024, 7, 1, 12, 0, 0, 0, jst), []string{"a", "c"}, 2},
+	}
+	for _, step := range steps {
+		if got := m.countDaily(step.ids, step.at); got != step.want {
+			t.Errorf("%s: count = %d, want %d", step.at, got, step.want)
+		}
+	}
+	if m.state.Day != "2024-07-01" {
+		t.Errorf("day = %q, want 2024-07-01", m.state.Day)
+	}
+}
+
+// testDef returns a single metric def, the shape makeDef produces per player.
+func testDef(name, id, displayName string) MetricDef {
+	return MetricDef{
+		Name:    "custom.player." + name,
+		Unit:    "integer",
+		Metrics: []MetricDetail{{Name: "custom.player." + name + "." + id, DisplayName: displayName}},
+	}
+}
+
+// defKeys returns the keys of defs in order.
+func defKeys(defs []MetricDef) []string {
+	keys := []string{}
+	for _, def := range defs {
+		keys = append(keys, defKey(def)+"="+def.Metrics[0].DisplayName)
+	}
+	return keys
+}
+
+func TestGraphDefs(t *testing.T) {
+	alice := testDef("level", "0001", "Alice")
+	bob := testDef("level", "0002", "Bob")
+	renamed := testDef("level", "0001", "Alice2")
+	carol := testDef("level", "0003", "Carol")
+
+	tests := []struct {
+		name    string
+		posted  []MetricDef
+		current []MetricDef
+		diff    []string // keys posted by diffDefs
+		merged  []string // mergeDefs(posted, diff)
+		pruned  []string // pruneDefs(merged, current)
+	}{
+		{
+			name:    "first run",
+			posted:  nil,
+			current: []MetricDef{alice, bob},
+			diff:    []string{"custom.player.level/custom.player.level.0001=Alice", "custom.player.level/custom.player.level.0002=Bob"},
+			merged:  []string{"custom.player.level/custom.player.level.0001=Alice", "custom.player.level/custom.player.level.0002=Bob"},
+			pruned:  []string{"custom.player.level/custom.player.level.0001=Alice", "custom.player.level/custom.player.level.0002=Bob"},
+		},
+		{
+			name:    "unchanged",
+			posted:  []MetricDef{alice, bob},
+			current: []MetricDef{alice, bob},
+			diff:    []string{},
+			merged:  []string{"custom.player.level/custom.player.level.0001=Alice", "custom.player.level/custom.player.level.0002=Bob"},
+			pruned:  []string{"custom.player.level/custom.player.level.0001=Alice", "custom.player.level/custom.player.level.0002=Bob"},
+		},
+		{
+			name:    "renamed player replaces the posted def",
+			posted:  []MetricDef{alice, bob},
+			current: []MetricDef{renamed, bob},
+			diff:    []string{"custom.player.level/custom.player.level.0001=Alice2"},
+			merged:  []string{"custom.player.level/custom.player.level.0001=Alice2", "custom.player.level/custom.player.level.0002=Bob"},
+			pruned:  []string{"custom.player.level/custom.player.level.0001=Alice2", "custom.player.level/custom.player.level.0002=Bob"},
+		},
+		{
+			name:    "departed players are pruned",
+			posted:  []MetricDef{alice, bob},
+			current: []MetricDef{carol},
+			diff:    []string{"custom.player.level/custom.player.level.0003=Carol"},
+			merged:  []string{"custom.player.level/custom.player.level.0001=Alice", "custom.player.level/custom.player.level.0002=Bob", "custom.player.level/custom.player.level.0003=Carol"},
+			pruned:  []string{"custom.player.level/custom.player.level.0003=Carol"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			diff := diffDefs(tt.posted, tt.current)
+			if got := defKeys(diff); !slices.Equal(got, tt.diff) {
+				t.Errorf("diffDefs = %q, want %q", got, tt.diff)
+			}
+			merged := mergeDefs(tt.posted, diff)
+			if got := defKeys(merged); !slices.Equal(got, tt.merged) {
+				t.Errorf("mergeDefs = %q, want %q", got, tt.merged)
+			}
+			if got := defKeys(pruneDefs(merged, tt.current)); !slices.Equal(got, tt.pruned) {
+				t.Errorf("pruneDefs = %q, want %q", got, tt.pruned)
+			}
+		})
+	}
+}
+
+// TestGraphDefsBounded churns the roster and checks the recorded defs stay
+// at the size of the current def set.
+func TestGraphDefsBounded(t *testing.T) {
+	m := newTestAPI(t, &fakeMackerel{}, "")
+	var posted []MetricDef
+	for i := 0; i < 50; i++ {
+		players := make([]telnet.Player, 2)
+		players[0].PltfmID = fmt.Sprintf("Steam_7656119800000%04d", i)
+		players[1].PltfmID = fmt.Sprintf("Steam_7656119800000%04d", i+1)
+		current := append(m.makeDef(players), serverDefs()...)
+		posted = pruneDefs(mergeDefs(posted, diffDefs(posted, current)), current)
+		if len(posted) != len(current) {
+			t.Fatalf("roster %d: %d defs recorded, want %d", i, len(posted), len(current))
+		}
+	}
+}
@@ -2,10 +2,15 @@ package telnet
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"math"
 	"net"
 	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -34,9 +39,38 @@ type Player struct {
 type Env struct {
 	ServerAddr string `default:"localhost:8081"`
 	TelnetPass string
+	// TelnetPromptMarkers end the login banner; matched case-insensitively
+	TelnetPromptMarkers []string `envconfig:"TELNET_PROMPT_MARKERS" default:"password"`
+	// TelnetLoginOK are the login success phrases of the supported server
+	// versions and locales; matched case-insensitively
+	TelnetLoginOK []string `envconfig:"TELNET_LOGIN_OK" default:"Logon successful,Login successful"`
+	// WorldBound is the largest |x| and |z| of the world, 0 for
+	// DefaultWorldBound
+	WorldBound float64 `envconfig:"WORLD_BOUND"`
 }
 
-var trimRe1 = regexp.MustCompile(`[0-9]\. `)
+// batchQuietPeriod is how long ExecBatch waits for more output before
+// treating a command as finished.
+const batchQuietPeriod = 500 * time.Millisecond
+
+// bannerQuietPeriod is how long connect waits for more banner lines when no
+// prompt marker has been seen.
+const bannerQuietPeriod = 1 * time.Second
+
+// ErrPartialPlayers is returned by GetPlayers when the player list was cut
+// short by the read deadline. It wraps context.DeadlineExceeded.
+var ErrPartialPlayers = fmt.Errorf("player list truncated: %w", context.DeadlineExceeded)
+
+// ErrPasswordRequired is returned when TelnetPass is not configured.
+var ErrPasswordRequired = errors.New("telnet password required")
+
+// ErrLoginFailed is returned when the server asks for the password again
+// after it was sent.
+var ErrLoginFailed = errors.New("login failed, check your password")
+
+// trimRe1 matches the list index at the start of an lp line only, so a name
+// or value containing "3. " is left intact.
+var trimRe1 = regexp.MustCompile(`^\s*\d+\.\s`)
 
 // parsePlayerInfo parses a player information line into a Player struct
 func parsePlayerInfo(line string) (Player, error) {
@@ -130,14 +164,93 @@ func splitWithCommas(line string) []string {
 	return parts
 }
 
+// isTimeout reports whether err is a network read deadline error.
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
 type Telnet7days struct {
 	Env
 	r    *bufio.Reader
 	w    *bufio.Writer
 	conn net.Conn
+	// localAddr is the local address of the connection.
+	localAddr string
+	// source is the address the server reports for our session in command
+	// echoes, learned from the echo of the first command. It tells our
+	// echoes apart from the same command run by another telnet session.
+	source string
+	// stopCancel unregisters the context cancellation set up by
+	// connectContext.
+	stopCancel func() bool
+	// deadline is the read deadline of the session.
+	deadline time.Time
+}
+
+// echoRe matches a command echo. Older servers don't report the source.
+var echoRe = regexp.MustCompile(`INF Executing command '(.*)' by Telnet(?: from (\S+))?`)
+
+// parseEcho extracts the command and the reporting source address from a
+// command echo line. source is empty if the server doesn't report it.
+func parseEcho(line string) (cmd, source string, ok bool) {
+	m := echoRe.FindStringSubmatch(line)
+	if m == nil {
+		return "", "", false
+	}
+	return m[1], m[2], true
+}
+
+// sameAddr reports whether two host:port addresses are equal. IPs are
+// compared by value so IPv6 forms and IPv4-mapped IPv6 addresses match.
+func sameAddr(a, b string) bool {
+	host, port, err := net.SplitHostPort(a)
+	if err != nil {
+		return a == b
+	}
+	otherHost, otherPort, err := net.SplitHostPort(b)
+	if err != nil {
+		return a == b
+	}
+	ip, otherIP := net.ParseIP(host), net.ParseIP(otherHost)
+	if ip == nil || otherIP == nil {
+		return host == otherHost && port == otherPort
+	}
+	return ip.Equal(otherIP) && port == otherPort
+}
+
+// fromOurSession reports whether an echo reported from source belongs to this
+// connection. Once our source is known only echoes from it are accepted.
+// Before that, an echo from our own host must come from our port; behind NAT
+// the server sees another address, so the first echo of the command is taken
+// as ours. Echoes without a source are always accepted.
+func (t *Telnet7days) fromOurSession(source string) bool {
+	if source == "" {
+		return true
+	}
+	if t.source != "" {
+		return sameAddr(source, t.source)
+	}
+	host, _, err := net.SplitHostPort(source)
+	if err != nil {
+		return true
+	}
+	localHost, _, err := net.SplitHostPort(t.localAddr)
+	if err != nil {
+		return true
+	}
+	ip, localIP := net.ParseIP(host), net.ParseIP(localHost)
+	if ip == nil || localIP == nil || !ip.Equal(localIP) {
+		return true
+	}
+	return sameAddr(source, t.localAddr)
 }
 
 func (t *Telnet7days) close() error {
+	if t.stopCancel != nil {
+		t.stopCancel()
+		t.stopCancel = nil
+	}
 	// Send "exit" command to logout
 	fmt.Fprintf(t.w, "exit\n")
 	t.w.Flush()
@@ -151,34 +264,123 @@ func (t *Telnet7days) close() error {
 	return nil
 }
 func (t *Telnet7days) connect() error {
+	return t.connectContext(context.Background())
+}
+
+// connectContext connects and logs in. The session's read deadline is capped
+// by the ctx deadline, and cancelling ctx aborts any pending read until the
+// connection is closed.
+func (t *Telnet7days) connectContext(ctx context.Context) error {
+	// An empty password line counts as a failed attempt on some servers,
+	// which then drop the connection with an unhelpful read error.
+	if strings.TrimSpace(t.TelnetPass) == "" {
+		return ErrPasswordRequired
+	}
 	// Connect to the server
 	var err error
-	t.conn, err = net.DialTimeout("tcp", t.ServerAddr, 10*time.Second)
+	dialer := net.Dialer{Timeout: 10 * time.Second}
+	t.conn, err = dialer.DialContext(ctx, "tcp", t.ServerAddr)
 	if err != nil {
 		return fmt.Errorf("Failed to connect to server: %v", err)
 	}
-	t.conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	t.localAddr = t.conn.LocalAddr().String()
+	t.source = ""
+	deadline := time.Now().Add(10 * time.Second)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	t.deadline = deadline
+	t.conn.SetReadDeadline(deadline)
+	conn := t.conn
+	t.stopCancel = context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
 	// Create a telnet reader and writer
 	t.r = bufio.NewReader(t.conn)
 	t.w = bufio.NewWriter(t.conn)
-	_, err = t.r.ReadString('\n')
-	if err != nil {
+	if err := t.login(deadline); err != nil {
+		t.stopCancel()
+		t.stopCancel = nil
+		t.conn.Close()
+		return err
+	}
+	return nil
+}
+
+// login reads the banner, sends the password and waits for the login to
+// succeed.
+func (t *Telnet7days) login(deadline time.Time) error {
+	if err := t.readBanner(deadline); err != nil {
 		return fmt.Errorf("Failed to read initial response: %v", err)
 	}
 	fmt.Fprintf(t.w, "%s\n", t.TelnetPass)
 	t.w.Flush()
 
-	// Read initial response after login
-	loginResp, err := t.r.ReadString('\n')
-	if err != nil {
-		return fmt.Errorf("Failed to read initial response: %v", err)
+	// Read the response after login until one of the success markers. Being
+	// prompted for the password again means the login failed.
+	for {
+		loginResp, err := t.r.ReadString('\n')
+		if containsAny(loginResp, t.loginOK()) {
+			return nil
+		}
+		if t.isPrompt(loginResp) {
+			return ErrLoginFailed
+		}
+		if err != nil {
+			return fmt.Errorf("Failed to read initial response: %v", err)
+		}
 	}
+}
 
-	// Check if login was successful
-	if !strings.Contains(loginResp, "Logon successful.") {
-		log.Fatal("Login failed. Check your password.")
+// loginOK returns the configured login success markers, falling back to the
+// English server message.
+func (t *Telnet7days) loginOK() []string {
+	if len(t.TelnetLoginOK) == 0 {
+		return []string{"Logon successful"}
 	}
-	return nil
+	return t.TelnetLoginOK
+}
+
+// containsAny reports whether line contains one of markers, ignoring case.
+func containsAny(line string, markers []string) bool {
+	line = strings.ToLower(line)
+	for _, marker := range markers {
+		if marker != "" && strings.Contains(line, strings.ToLower(marker)) {
+			return true
+		}
+	}
+	return false
+}
+
+// readBanner reads the login banner until a line contains one of the prompt
+// markers, or until the server has been quiet for bannerQuietPeriod after
+// sending something, so the password isn't sent in the middle of a
+// multi-line banner.
+func (t *Telnet7days) readBanner(deadline time.Time) error {
+	defer t.conn.SetReadDeadline(deadline)
+	received := false
+	for {
+		quiet := time.Now().Add(bannerQuietPeriod)
+		if !received || quiet.After(deadline) {
+			quiet = deadline
+		}
+		t.conn.SetReadDeadline(quiet)
+		line, err := t.r.ReadString('\n')
+		if t.isPrompt(line) {
+			return nil
+		}
+		if err != nil {
+			if received && isTimeout(err) && time.Now().Before(deadline) {
+				return nil
+			}
+			return err
+		}
+		received = true
+	}
+}
+
+func (t *Telnet7days) isPrompt(line string) bool {
+	return containsAny(line, t.TelnetPromptMarkers)
 }
 
 func (t *Telnet7days) exec(cmd string) error {
@@ -193,29 +395,188 @@ func (t *Telnet7days) exec(cmd string) error {
 		}
 
 		//log.Printf("line:'%s'", line)
-		// Check if the response contains the command we executed
-		if strings.Contains(line, fmt.Sprintf("INF Executing command '%s' by Telnet", cmd)) {
+		// Check if the response contains the command we executed from our
+		// own session
+		echoCmd, source, ok := parseEcho(line)
+		if ok && echoCmd == cmd && t.fromOurSession(source) {
+			if t.source == "" {
+				t.source = source
+			}
 			break
 		}
 	}
 	return nil
 }
 
-func (t *Telnet7days) GetPlayers() ([]Player, error) {
-	if err := t.connect(); err != nil {
+// Ping connects and logs in without running a command.
+func (t *Telnet7days) Ping(ctx context.Context) error {
+	if err := t.connectContext(ctx); err != nil {
+		return err
+	}
+	return t.close()
+}
+
+// WaitReady pings the server until it accepts a login, retrying with
+// exponential backoff capped at maxBackoff, or until ctx is done.
+func (t *Telnet7days) WaitReady(ctx context.Context, maxBackoff time.Duration) error {
+	backoff := time.Second
+	for {
+		err := t.Ping(ctx)
+		if err == nil {
+			return nil
+		}
+		log.Printf("Waiting for server %s: %v (retry in %s)", t.ServerAddr, err, backoff)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+// ExecCapture runs cmd and returns its output lines, from the line after the
+// command echo up to and including the first line for which until returns
+// true. On a read error the lines captured so far are returned with the
+// error.
+func (t *Telnet7days) ExecCapture(cmd string, until func(line string) bool) ([]string, error) {
+	return t.execCaptureContext(context.Background(), cmd, until)
+}
+
+func (t *Telnet7days) execCaptureContext(ctx context.Context, cmd string, until func(line string) bool) ([]string, error) {
+	if err := t.connectContext(ctx); err != nil {
 		return nil, err
 	}
 	defer t.close()
-
-	if err := t.exec("lp"); err != nil {
+	if err := t.exec(cmd); err != nil {
 		return nil, err
 	}
-	var players []Player
+	var lines []string
+	for {
+		line, err := t.r.ReadString('\n')
+		if err != nil {
+			if ctx.Err() != nil {
+				return lines, fmt.Errorf("Error reading cmd:'%s' output: %w: %w", cmd, ctx.Err(), err)
+			}
+			return lines, fmt.Errorf("Error reading cmd:'%s' output: %w", cmd, err)
+		}
+		line = strings.TrimRight(line, "\r\n")
+		lines = append(lines, line)
+		if until(line) {
+			return lines, nil
+		}
+	}
+}
+
+// readUntilQuiet collects output lines until nothing has been received for
+// the quiet period. Reads never extend past the session deadline, so a server
+// that keeps streaming log lines can't hold it forever. When ctx is done the
+// lines so far are returned with ctx.Err().
+func (t *Telnet7days) readUntilQuiet(ctx context.Context, quiet time.Duration) ([]string, error) {
+	defer t.setReadDeadline(ctx, t.deadline)
+	var lines []string
 	for {
+		deadline := time.Now().Add(quiet)
+		if deadline.After(t.deadline) {
+			deadline = t.deadline
+		}
+		if err := t.setReadDeadline(ctx, deadline); err != nil {
+			return lines, err
+		}
 		line, err := t.r.ReadString('\n')
 		if err != nil {
-			return nil, fmt.Errorf("Error reading player data information: %v", err)
+			if ctx.Err() != nil {
+				return lines, ctx.Err()
+			}
+			if !isTimeout(err) {
+				return lines, err
+			}
+			if !time.Now().Before(t.deadline) {
+				return lines, fmt.Errorf("%w: %w", context.DeadlineExceeded, err)
+			}
+			return lines, nil
 		}
+		lines = append(lines, strings.TrimRight(line, "\r\n"))
+	}
+}
+
+// setReadDeadline sets the read deadline without undoing the cancellation of
+// ctx: if ctx is done, reads are aborted and ctx.Err() is returned.
+func (t *Telnet7days) setReadDeadline(ctx context.Context, deadline time.Time) error {
+	t.conn.SetReadDeadline(deadline)
+	// The cancellation may have set its deadline just before ours.
+	if err := ctx.Err(); err != nil {
+		t.conn.SetReadDeadline(time.Now())
+		return err
+	}
+	return nil
+}
+
+// ExecBatch logs in once, runs cmds sequentially on the same connection and
+// logs out once. The output of cmds[i] is returned in res[i] as
+// newline-joined lines. On error the outputs collected so far are returned
+// and the connection is closed.
+func (t *Telnet7days) ExecBatch(cmds []string) ([]string, error) {
+	return t.execBatchContext(context.Background(), cmds)
+}
+
+func (t *Telnet7days) execBatchContext(ctx context.Context, cmds []string) ([]string, error) {
+	if err := t.connectContext(ctx); err != nil {
+		return nil, err
+	}
+	defer t.close()
+
+	res := make([]string, 0, len(cmds))
+	for _, cmd := range cmds {
+		if err := t.exec(cmd); err != nil {
+			return res, err
+		}
+		lines, err := t.readUntilQuiet(ctx, batchQuietPeriod)
+		if err != nil {
+			return res, fmt.Errorf("Error reading cmd:'%s' output: %w", cmd, err)
+		}
+		res = append(res, strings.Join(lines, "\n"))
+	}
+	return res, nil
+}
+
+// SaveWorld runs saveworld and waits for the server to confirm the world was
+// flushed to disk. It reports false without error if the read deadline
+// passes before the confirmation line is seen.
+func (t *Telnet7days) SaveWorld() (bool, error) {
+	_, err := t.ExecCapture("saveworld", func(line string) bool {
+		return strings.Contains(line, "World saved")
+	})
+	if isTimeout(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// GetPlayers runs lp and returns the online players.
+func (t *Telnet7days) GetPlayers() ([]Player, error) {
+	return t.GetPlayersContext(context.Background())
+}
+
+// GetPlayersContext runs lp and returns the online players, giving up when
+// ctx is done.
+//
+// If the read deadline passes or ctx is done while the player lines are
+// being read, the players parsed so far are returned together with an error
+// wrapping both ErrPartialPlayers and the read error, so callers can decide to
+// use the partial list.
+func (t *Telnet7days) GetPlayersContext(ctx context.Context) ([]Player, error) {
+	lines, err := t.execCaptureContext(ctx, "lp", func(line string) bool {
+		return strings.Contains(line, "Total of ")
+	})
+	if err != nil && !isTimeout(err) {
+		return nil, err
+	}
+	var players []Player
+	for _, line := range lines {
 		if strings.Contains(line, "Total of ") {
 			break
 		}
@@ -225,24 +586,44 @@ func (t *Telnet7days) GetPlayers() ([]Player, error) {
 			return nil, fmt.Errorf("Failed to parse player information: %v", err)
 		}
 		players = append(players, player)
-
+	}
+	if err != nil {
+		return players, fmt.Errorf("Error reading player data information: %w: %w", ErrPartialPlayers, err)
 	}
 	return players, nil
 }
-func (t *Telnet7days) GetTime() (GameTime, error) {
-	res := GameTime{}
-	if err := t.connect(); err != nil {
-		return res, err
+
+// GetPlayer runs lp and returns the online player whose name matches name
+// case-insensitively.
+func (t *Telnet7days) GetPlayer(name string) (Player, error) {
+	players, err := t.GetPlayers()
+	if err != nil && !errors.Is(err, ErrPartialPlayers) {
+		return Player{}, err
 	}
-	defer t.close()
-	if err := t.exec("gt"); err != nil {
-		return res, err
+	for _, player := range players {
+		if strings.EqualFold(player.Name, name) {
+			return player, nil
+		}
 	}
-	line, err := t.r.ReadString('\n')
-	log.Printf("line:'%s'", line)
+	if err != nil {
+		return Player{}, err
+	}
+	return Player{}, fmt.Errorf("player not found: '%s'", name)
+}
+
+func (t *Telnet7days) GetTime() (GameTime, error) {
+	return t.GetTimeContext(context.Background())
+}
+
+// GetTimeContext is GetTime giving up when ctx is done.
+func (t *Telnet7days) GetTimeContext(ctx context.Context) (GameTime, error) {
+	res := GameTime{}
+	lines, err := t.execCaptureContext(ctx, "gt", func(string) bool { return true })
 	if err != nil {
 		return res, err
 	}
+	line := lines[0]
+	log.Printf("line:'%s'", line)
 	if !strings.HasPrefix(line, "Day ") {
 		return res, fmt.Errorf("Failed to parse time: %s", line)
 	}
@@ -255,6 +636,38 @@ type GameTime struct {
 	Minutes int `json:"minutes"`
 }
 
+// DefaultBloodMoonCycle is the default BloodMoonFrequency game pref.
+const DefaultBloodMoonCycle = 7
+
+// DaysUntilBloodMoon returns the number of game days until the next blood
+// moon day, 0 on a blood moon day. cycle is the BloodMoonFrequency.
+func (g GameTime) DaysUntilBloodMoon(cycle int) int {
+	if cycle <= 0 {
+		cycle = DefaultBloodMoonCycle
+	}
+	r := g.Days % cycle
+	if r == 0 && g.Days > 0 {
+		return 0
+	}
+	return cycle - r
+}
+
+// IsBloodMoonNight reports whether the game time is within a blood moon
+// night, which starts at 22:00 on every cycle-th day and lasts until 04:00
+// the next day. A cycle of 0 or less means blood moons are disabled.
+func (g GameTime) IsBloodMoonNight(cycle int) bool {
+	if cycle <= 0 {
+		return false
+	}
+	if g.Hours >= 22 {
+		return g.Days > 0 && g.Days%cycle == 0
+	}
+	if g.Hours < 4 {
+		return g.Days > 1 && (g.Days-1)%cycle == 0
+	}
+	return false
+}
+
 func parseGameTime(timeStr string) (GameTime, error) {
 	var gameTime GameTime
 
@@ -280,6 +693,364 @@ func parseGameTime(timeStr string) (GameTime, error) {
 	return gameTime, nil
 }
 
+// MemInfo is the server status reported by the mem command.
+type MemInfo struct {
+	FPS      *float64 `json:"fps,omitempty"` // nil if the server does not report fps
+	Heap     float64  `json:"heap"`          // MB
+	Chunks   int      `json:"chunks"`
+	Players  int      `json:"players"`
+	Zombies  int      `json:"zombies"`
+	Entities int      `json:"entities"`
+}
+
+var (
+	memFPSRe      = regexp.MustCompile(`FPS: ([0-9.]+)`)
+	memHeapRe     = regexp.MustCompile(`Heap: ([0-9.]+)MB`)
+	memChunksRe   = regexp.MustCompile(`Chunks: ([0-9]+)`)
+	memPlayersRe  = regexp.MustCompile(`Ply: ([0-9]+)`)
+	memZombiesRe  = regexp.MustCompile(`Zom: ([0-9]+)`)
+	memEntitiesRe = regexp.MustCompile(`Ent: ([0-9]+)`)
+)
+
+// parseMemInfo parses a mem output line. Fields missing from the line are
+// left at their zero value.
+func parseMemInfo(line string) (MemInfo, error) {
+	var mem MemInfo
+	m := memZombiesRe.FindStringSubmatch(line)
+	if m == nil {
+		return mem, fmt.Errorf("invalid mem format: %s", line)
+	}
+	fmt.Sscanf(m[1], "%d", &mem.Zombies)
+	if m := memFPSRe.FindStringSubmatch(line); m != nil {
+		var fps float64
+		if _, err := fmt.Sscanf(m[1], "%f", &fps); err == nil {
+			mem.FPS = &fps
+		}
+	}
+	if m := memHeapRe.FindStringSubmatch(line); m != nil {
+		fmt.Sscanf(m[1], "%f", &mem.Heap)
+	}
+	if m := memChunksRe.FindStringSubmatch(line); m != nil {
+		fmt.Sscanf(m[1], "%d", &mem.Chunks)
+	}
+	if m := memPlayersRe.FindStringSubmatch(line); m != nil {
+		fmt.Sscanf(m[1], "%d", &mem.Players)
+	}
+	if m := memEntitiesRe.FindStringSubmatch(line); m != nil {
+		fmt.Sscanf(m[1], "%d", &mem.Entities)
+	}
+	return mem, nil
+}
+
+// GetMem runs mem and returns the reported server status, including the
+// number of hostiles alive.
+func (t *Telnet7days) GetMem() (MemInfo, error) {
+	return t.GetMemContext(context.Background())
+}
+
+// GetMemContext is GetMem giving up when ctx is done.
+func (t *Telnet7days) GetMemContext(ctx context.Context) (MemInfo, error) {
+	lines, err := t.execCaptureContext(ctx, "mem", func(line string) bool {
+		return strings.Contains(line, "Zom: ")
+	})
+	if err != nil {
+		return MemInfo{}, err
+	}
+	return parseMemInfo(lines[len(lines)-1])
+}
+
+/*
+mem
+2024-06-30T09:56:10 17457.102 INF Executing command 'mem' by Telnet from 10.8.0.1:52594
+2024-06-30T09:56:10 17457.103 INF Time: 290.77m FPS: 37.02 Heap: 2173.9MB Max: 2766.2MB Chunks: 529 CGO: 24 Ply: 1 Zom: 8 Ent: 19 (173) Items: 0 CO: 2 RSS: 5731.27MB
+*/
+
+// Ban is an entry of the server's ban list.
+type Ban struct {
+	ID     string    `json:"id"`
+	Name   string    `json:"name"`
+	Until  time.Time `json:"until"`
+	Reason string    `json:"reason"`
+}
+
+var banRe = regexp.MustCompile(`^\s*(.+?) - (\S+)(?: \((.*?)\))?(?: - (.*))?$`)
+
+// banTimeLayouts are the "banned until" formats seen across server versions
+// and locales.
+var banTimeLayouts = []string{
+	"2006-01-02 15:04:05",
+	"2006/01/02 15:04:05",
+	"01/02/2006 15:04:05",
+	"1/2/2006 3:04:05 PM",
+	time.RFC3339,
+}
+
+// parseBanLine parses a ban list entry. ok is false for the header and any
+// other line that is not an entry.
+func parseBanLine(line string) (Ban, bool) {
+	m := banRe.FindStringSubmatch(strings.TrimRight(line, "\r\n"))
+	if m == nil {
+		return Ban{}, false
+	}
+	for _, layout := range banTimeLayouts {
+		until, err := time.ParseInLocation(layout, strings.TrimSpace(m[1]), time.Local)
+		if err == nil {
+			return Ban{ID: m[2], Name: m[3], Until: until, Reason: strings.TrimSpace(m[4])}, true
+		}
+	}
+	return Ban{}, false
+}
+
+// GetBans runs "ban list" and returns the active bans. An empty ban list
+// returns no entries and no error.
+func (t *Telnet7days) GetBans() ([]Ban, error) {
+	out, err := t.ExecBatch([]string{"ban list"})
+	if err != nil {
+		return nil, err
+	}
+	return parseBans(out[0]), nil
+}
+
+// platformIDRe matches the platform user ids accepted by the ban commands;
+// a bare 17 digit id is taken as a Steam id.
+var platformIDRe = regexp.MustCompile(`^(?:(?:Steam_)?[0-9]{17}|EOS_[0-9a-fA-F]{32})$`)
+
+// parseBans returns the ban entries in a "ban list" output.
+func parseBans(out string) []Ban {
+	bans := []Ban{}
+	for _, line := range strings.Split(out, "\n") {
+		if ban, ok := parseBanLine(line); ok {
+			bans = append(bans, ban)
+		}
+	}
+	return bans
+}
+
+func hasBan(bans []Ban, id string) bool {
+	for _, ban := range bans {
+		if ban.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// BanRemove lifts the ban on id using "ban remove". It reports false
+// without error when id was not banned, and an error if the ban is still
+// listed afterwards.
+func (t *Telnet7days) BanRemove(id string) (bool, error) {
+	if !platformIDRe.MatchString(id) {
+		return false, fmt.Errorf("invalid user id: '%s'", id)
+	}
+	if !strings.Contains(id, "_") {
+		id = "Steam_" + id
+	}
+	out, err := t.ExecBatch([]string{"ban list", "ban remove " + id, "ban list"})
+	if err != nil {
+		return false, err
+	}
+	if !hasBan(parseBans(out[0]), id) {
+		return false, nil
+	}
+	if hasBan(parseBans(out[2]), id) {
+		return false, fmt.Errorf("Failed to remove ban for %s: %s", id, out[1])
+	}
+	return true, nil
+}
+
+/*
+ban list
+2024-06-30T09:57:02 17509.221 INF Executing command 'ban list' by Telnet from 10.8.0.1:52594
+Ban list entries:
+  Banned until - UserID (name) - Reason
+  2024-07-07 09:57:00 - Steam_76561198000000000 (PlayerName) - griefing
+*/
+
+var gamePrefRe = regexp.MustCompile(`GamePref\.(\w+) = (.*)$`)
+
+// parseGamePrefs parses getgamepref output into a name to value map. When
+// keys are given only those prefs are kept, matched case-insensitively.
+func parseGamePrefs(out string, keys ...string) map[string]string {
+	prefs := map[string]string{}
+	for _, line := range strings.Split(out, "\n") {
+		m := gamePrefRe.FindStringSubmatch(strings.TrimRight(line, "\r"))
+		if m == nil {
+			continue
+		}
+		if len(keys) > 0 && !slices.ContainsFunc(keys, func(k string) bool { return strings.EqualFold(k, m[1]) }) {
+			continue
+		}
+		prefs[m[1]] = strings.TrimSpace(m[2])
+	}
+	return prefs
+}
+
+// GetGamePrefs runs getgamepref and returns the game preferences. When keys
+// are given only those prefs are returned.
+func (t *Telnet7days) GetGamePrefs(keys ...string) (map[string]string, error) {
+	return t.GetGamePrefsContext(context.Background(), keys...)
+}
+
+// GetGamePrefsContext is GetGamePrefs giving up when ctx is done.
+func (t *Telnet7days) GetGamePrefsContext(ctx context.Context, keys ...string) (map[string]string, error) {
+	out, err := t.execBatchContext(ctx, []string{"getgamepref"})
+	if err != nil {
+		return nil, err
+	}
+	return parseGamePrefs(out[0], keys...), nil
+}
+
+// GetBloodMoonCycleContext returns the server's BloodMoonFrequency game pref.
+func (t *Telnet7days) GetBloodMoonCycleContext(ctx context.Context) (int, error) {
+	prefs, err := t.GetGamePrefsContext(ctx, "BloodMoonFrequency")
+	if err != nil {
+		return 0, err
+	}
+	cycle, err := strconv.Atoi(prefs["BloodMoonFrequency"])
+	if err != nil || cycle <= 0 {
+		return 0, fmt.Errorf("invalid BloodMoonFrequency: '%s'", prefs["BloodMoonFrequency"])
+	}
+	return cycle, nil
+}
+
+/*
+getgamepref
+2024-06-30T09:58:12 17579.510 INF Executing command 'getgamepref' by Telnet from 10.8.0.1:52594
+GamePref.BloodMoonFrequency = 7
+GamePref.DayNightLength = 60
+GamePref.GameDifficulty = 2
+GamePref.LootRespawnDays = 7
+*/
+
+// Version is the game server version reported by the version command.
+type Version struct {
+	Game  string `json:"game"`  // e.g. "V 1.0"
+	Build string `json:"build"` // e.g. "b333"
+}
+
+var versionRe = regexp.MustCompile(`Game version: (.+?) \((b[0-9]+)\)`)
+
+func parseVersion(out string) (Version, error) {
+	m := versionRe.FindStringSubmatch(out)
+	if m == nil {
+		return Version{}, fmt.Errorf("invalid version format: %s", out)
+	}
+	return Version{Game: m[1], Build: m[2]}, nil
+}
+
+// GetVersion runs version and returns the game version and build.
+func (t *Telnet7days) GetVersion() (Version, error) {
+	out, err := t.ExecBatch([]string{"version"})
+	if err != nil {
+		return Version{}, err
+	}
+	return parseVersion(out[0])
+}
+
+/*
+version
+2024-06-30T09:58:40 17607.012 INF Executing command 'version' by Telnet from 10.8.0.1:52594
+Game version: V 1.0 (b333) Compatibility Version: V 1.0
+Mod TFP_CommandExtensions: 1.0.0
+Mod TFP_MapRendering: 1.0.0
+Mod TFP_WebServer: 1.0.0
+*/
+
+const (
+	// DefaultWorldBound bounds the x and z coordinates of the largest
+	// generated world.
+	DefaultWorldBound = 10240
+	// WorldHeight is the top of the world.
+	WorldHeight = 255
+)
+
+// InWorld reports whether (x, y, z) is inside the world: |x| and |z| within
+// WorldBound and y between 0 and WorldHeight.
+func (e Env) InWorld(x, y, z float64) bool {
+	bound := e.WorldBound
+	if bound <= 0 {
+		bound = DefaultWorldBound
+	}
+	return math.Abs(x) <= bound && math.Abs(z) <= bound && y >= 0 && y <= WorldHeight
+}
+
+// Teleport moves the player with entityID to (x, y, z) using
+// teleportplayer. The move is confirmed by listing the players afterwards
+// and checking the player's x and z, as the server may adjust y to the
+// ground. Coordinates outside the world are rejected, see InWorld.
+func (t *Telnet7days) Teleport(entityID int, x, y, z float64) error {
+	if !t.InWorld(x, y, z) {
+		return fmt.Errorf("coordinates out of world bounds: (%g, %g, %g)", x, y, z)
+	}
+	cmd := fmt.Sprintf("teleportplayer %d %d %d %d", entityID, int(x), int(y), int(z))
+	out, err := t.ExecBatch([]string{cmd, "lp"})
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(out[1], "\n") {
+		player, err := parsePlayerInfo(line)
+		if err != nil || player.ID != entityID {
+			continue
+		}
+		if math.Abs(player.Position.X-x) > 2 || math.Abs(player.Position.Z-z) > 2 {
+			return fmt.Errorf("Failed to teleport player %d: now at (%g, %g, %g): %s",
+				entityID, player.Position.X, player.Position.Y, player.Position.Z, out[0])
+		}
+		return nil
+	}
+	return fmt.Errorf("player not found: %d: %s", entityID, out[0])
+}
+
+// Admin is a user entry of the server's admin list.
+type Admin struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	Level int    `json:"level"` // permission level, 0 is the highest
+}
+
+var adminRe = regexp.MustCompile(`^\s*(-?[0-9]+):\s+(\S+)(?:\s+\((.*)\))?`)
+
+// parseAdmins parses the user section of "admin list" output. Group
+// permissions listed after it are ignored.
+func parseAdmins(out string) []Admin {
+	admins := []Admin{}
+	inUsers := false
+	for _, line := range strings.Split(out, "\n") {
+		if strings.Contains(line, "Defined ") {
+			inUsers = strings.Contains(line, "User")
+			continue
+		}
+		if !inUsers {
+			continue
+		}
+		m := adminRe.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		level, _ := strconv.Atoi(m[1])
+		admins = append(admins, Admin{ID: m[2], Name: m[3], Level: level})
+	}
+	return admins
+}
+
+// GetAdmins runs "admin list" and returns the user admins. An empty list
+// returns no entries and no error.
+func (t *Telnet7days) GetAdmins() ([]Admin, error) {
+	out, err := t.ExecBatch([]string{"admin list"})
+	if err != nil {
+		return nil, err
+	}
+	return parseAdmins(out[0]), nil
+}
+
+/*
+admin list
+2024-06-30T09:59:21 17648.330 INF Executing command 'admin list' by Telnet from 10.8.0.1:52594
+Defined User Permissions:
+  0: Steam_76561198000000000 (PlayerName)
+Defined Group Permissions:
+*/
+
 /*
 gt
 2024-06-30T09:55:59 17446.408 INF Executing command 'gt' by Telnet from 10.8.0.1:52594
@@ -0,0 +1,534 @@
+package telnet
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/masahide/mackerel-7dtd/pkg/telnet/telnettest"
+)
+
+func TestConnectPasswordRequired(t *testing.T) {
+	for _, pass := range []string{"", "  \t"} {
+		tn := &Telnet7days{Env: Env{ServerAddr: "127.0.0.1:1", TelnetPass: pass}}
+		if err := tn.connect(); !errors.Is(err, ErrPasswordRequired) {
+			t.Errorf("password %q: err = %v, want ErrPasswordRequired", pass, err)
+		}
+	}
+}
+
+func TestParsePlayerInfo(t *testing.T) {
+	tests := []struct {
+		line  string
+		name  string
+		id    int
+		level int
+	}{
+		{"0. id=171, Alice, pos=(-1234.5, 61.0, 567.8), level=5, pltfmid=Steam_76561198000000001", "Alice", 171, 5},
+		{"12. id=172, Team 3. Bob, pos=(1.0, 2.0, 3.0), level=7, pltfmid=Steam_76561198000000002", "Team 3. Bob", 172, 7},
+		{"  3. id=173, 3. Carol, pos=(1.0, 2.0, 3.0), level=9, pltfmid=EOS_0003", "3. Carol", 173, 9},
+	}
+	for _, tt := range tests {
+		player, err := parsePlayerInfo(tt.line)
+		if err != nil {
+			t.Errorf("%q: %v", tt.line, err)
+			continue
+		}
+		if player.Name != tt.name || player.ID != tt.id || player.Level != tt.level {
+			t.Errorf("%q: got name=%q id=%d level=%d, want name=%q id=%d level=%d",
+				tt.line, player.Name, player.ID, player.Level, tt.name, tt.id, tt.level)
+		}
+	}
+}
+
+func TestLoginMultiLineBanner(t *testing.T) {
+	tests := []struct {
+		banner  []string
+		prompt  string
+		markers []string
+	}{
+		{
+			[]string{"*** Connected with 7DTD server.", "*** Server version: V 1.0 (b333) Compatibility Version: V 1.0", ""},
+			"Please enter password:",
+			[]string{"password"},
+		},
+		{
+			[]string{"*** Verbunden mit dem 7DTD-Server.", "*** Serverversion: V 1.0 (b333)"},
+			"Bitte Passwort eingeben:",
+			[]string{"password", "passwort"},
+		},
+	}
+	for _, tt := range tests {
+		// Nothing may be sent before the prompt.
+		server := &telnettest.Server{Banner: tt.banner, PromptDelay: 200 * time.Millisecond, Prompt: tt.prompt}
+		server.Start(t)
+		tn := &Telnet7days{Env: Env{ServerAddr: server.Addr, TelnetPass: "secret", TelnetPromptMarkers: tt.markers}}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err := tn.Ping(ctx)
+		cancel()
+		if early := server.Early(); len(early) > 0 {
+			t.Errorf("prompt %q: sent %q before the prompt", tt.prompt, early)
+		}
+		if err != nil {
+			t.Errorf("prompt %q: %v", tt.prompt, err)
+		}
+	}
+}
+
+func TestLoginSuccessPhrases(t *testing.T) {
+	tests := []struct {
+		ok      string
+		markers []string
+	}{
+		{"Logon successful.", nil},
+		{"Logon successful.", []string{"Logon successful", "Login successful"}},
+		{"Login successful.", []string{"Logon successful", "Login successful"}},
+		{"LOGIN SUCCESSFUL", []string{"Logon successful", "Login successful"}},
+		{"Anmeldung erfolgreich.", []string{"Logon successful", "Anmeldung erfolgreich"}},
+	}
+	for _, tt := range tests {
+		server := &telnettest.Server{LoginOK: tt.ok}
+		server.Start(t)
+		tn := &Telnet7days{Env: Env{ServerAddr: server.Addr, TelnetPass: "secret", TelnetPromptMarkers: []string{"password"}, TelnetLoginOK: tt.markers}}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := tn.Ping(ctx); err != nil {
+			t.Errorf("%q with %q: %v", tt.ok, tt.markers, err)
+		}
+		cancel()
+	}
+}
+
+func TestLoginFailed(t *testing.T) {
+	server := telnettest.NewServer(t, nil)
+	tn := &Telnet7days{Env: Env{ServerAddr: server.Addr, TelnetPass: "wrong", TelnetPromptMarkers: []string{"password"}}}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := tn.Ping(ctx); !errors.Is(err, ErrLoginFailed) {
+		t.Errorf("err = %v, want ErrLoginFailed", err)
+	}
+}
+
+func TestTeleportOutOfBounds(t *testing.T) {
+	tn := &Telnet7days{Env: Env{ServerAddr: "127.0.0.1:1", TelnetPass: "secret", WorldBound: 4096}}
+	for _, pos := range [][3]float64{{5000, 60, 0}, {0, 60, -4097}, {0, -1, 0}, {0, 256, 0}} {
+		err := tn.Teleport(171, pos[0], pos[1], pos[2])
+		if err == nil || !strings.Contains(err.Error(), "out of world bounds") {
+			t.Errorf("%v: err = %v, want out of world bounds", pos, err)
+		}
+	}
+}
+
+func TestParseVersion(t *testing.T) {
+	// Captured from the version command; see the sample next to GetVersion.
+	out := "Game version: V 1.0 (b333) Compatibility Version: V 1.0\n" +
+		"Mod TFP_CommandExtensions: 1.0.0\n" +
+		"Mod TFP_MapRendering: 1.0.0\n" +
+		"Mod TFP_WebServer: 1.0.0"
+	v, err := parseVersion(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Game != "V 1.0" || v.Build != "b333" {
+		t.Errorf("got %+v, want V 1.0 b333", v)
+	}
+	if _, err := parseVersion("Mod TFP_WebServer: 1.0.0"); err == nil {
+		t.Error("want error for output without a game version")
+	}
+}
+
+func newTestTelnet(addr string) *Telnet7days {
+	return &Telnet7days{Env: Env{ServerAddr: addr, TelnetPass: "secret", TelnetPromptMarkers: []string{"password"}}}
+}
+
+func TestExecBatch(t *testing.T) {
+	server := telnettest.NewServer(t, map[string][]string{
+		"gt":          {"Day 17, 15:27"},
+		"getgamepref": {"GamePref.BloodMoonFrequency = 7", "GamePref.DayNightLength = 60"},
+	})
+	res, err := newTestTelnet(server.Addr).ExecBatch([]string{"gt", "getgamepref", "gt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"Day 17, 15:27",
+		"GamePref.BloodMoonFrequency = 7\nGamePref.DayNightLength = 60",
+		"Day 17, 15:27",
+	}
+	if !slices.Equal(res, want) {
+		t.Errorf("got %q, want %q", res, want)
+	}
+}
+
+func TestExecBatchMidBatchError(t *testing.T) {
+	server := telnettest.NewServer(t, map[string][]string{"gt": {"Day 17, 15:27"}})
+	server.HandleFunc("mem", func(c *telnettest.Conn, cmd string) error {
+		c.Echo(cmd, c.Source())
+		c.Println("2024-06-30T09:56:10 17457.103 INF Time: 290.77m FPS: 37.02")
+		return errors.New("drop the connection")
+	})
+	res, err := newTestTelnet(server.Addr).ExecBatch([]string{"gt", "mem", "gt"})
+	if err == nil {
+		t.Fatal("want error when the connection drops mid-batch")
+	}
+	if !slices.Equal(res, []string{"Day 17, 15:27"}) {
+		t.Errorf("got %q, want the output before the error", res)
+	}
+}
+
+// stream answers a command with log lines that never go quiet.
+func stream(c *telnettest.Conn, cmd string) error {
+	c.Echo(cmd, c.Source())
+	for i := 0; ; i++ {
+		if _, err := fmt.Fprintf(c, "2024-06-30T09:56:10 17457.103 INF Log line %d\r\n", i); err != nil {
+			return err
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestExecBatchBusyServer(t *testing.T) {
+	server := telnettest.NewServer(t, nil)
+	server.HandleFunc("getgamepref", stream)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	start := time.Now()
+	_, err := newTestTelnet(server.Addr).execBatchContext(ctx, []string{"getgamepref"})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err = %v, want context.DeadlineExceeded", err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("returned after %s, want about 1s", d)
+	}
+}
+
+func TestExecBatchCancel(t *testing.T) {
+	server := telnettest.NewServer(t, nil)
+	server.HandleFunc("getgamepref", stream)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(300*time.Millisecond, cancel)
+	start := time.Now()
+	_, err := newTestTelnet(server.Addr).GetGamePrefsContext(ctx)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("err = %v, want context.Canceled", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("returned after %s, want about 300ms", d)
+	}
+}
+
+func TestParseEcho(t *testing.T) {
+	tests := []struct {
+		line   string
+		cmd    string
+		source string
+		ok     bool
+	}{
+		{"2024-06-30T09:56:10 17457.102 INF Executing command 'lp' by Telnet from 10.8.0.1:52594", "lp", "10.8.0.1:52594", true},
+		{"2024-06-30T09:56:10 17457.102 INF Executing command 'ban list' by Telnet from [2001:db8::1]:52594", "ban list", "[2001:db8::1]:52594", true},
+		{"2024-06-30T09:56:10 17457.102 INF Executing command 'gt' by Telnet from [::ffff:10.8.0.1]:52594", "gt", "[::ffff:10.8.0.1]:52594", true},
+		{"2024-06-30T09:56:10 17457.102 INF Executing command 'gt' by Telnet", "gt", "", true},
+		{"2024-06-30T09:56:10 17457.102 INF Executing command 'gt' by WebCommandApi from 10.8.0.1", "", "", false},
+		{"Day 17, 15:27", "", "", false},
+	}
+	for _, tt := range tests {
+		cmd, source, ok := parseEcho(tt.line)
+		if cmd != tt.cmd || source != tt.source || ok != tt.ok {
+			t.Errorf("%q: got %q, %q, %v, want %q, %q, %v", tt.line, cmd, source, ok, tt.cmd, tt.source, tt.ok)
+		}
+	}
+}
+
+func TestSameAddr(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"10.8.0.1:52594", "10.8.0.1:52594", true},
+		{"10.8.0.1:52594", "10.8.0.1:52595", false},
+		{"10.8.0.1:52594", "10.8.0.2:52594", false},
+		{"10.8.0.1:52594", "[::ffff:10.8.0.1]:52594", true},
+		{"[::ffff:10.8.0.1]:52594", "[::ffff:10.8.0.1]:52595", false},
+		{"[2001:db8::1]:52594", "[2001:0db8:0:0::1]:52594", true},
+		{"[2001:db8::1]:52594", "[2001:db8::2]:52594", false},
+		{"[::1]:52594", "127.0.0.1:52594", false},
+	}
+	for _, tt := range tests {
+		if got := sameAddr(tt.a, tt.b); got != tt.want {
+			t.Errorf("sameAddr(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestFromOurSession(t *testing.T) {
+	tests := []struct {
+		localAddr string
+		source    string // learned from an earlier echo
+		echo      string
+		want      bool
+	}{
+		// same host: the port tells sessions apart
+		{"127.0.0.1:40000", "", "127.0.0.1:40000", true},
+		{"127.0.0.1:40000", "", "127.0.0.1:40001", false},
+		{"127.0.0.1:40000", "", "[::ffff:127.0.0.1]:40000", true},
+		{"[::1]:40000", "", "[::1]:40001", false},
+		// behind NAT the first echo is taken as ours ...
+		{"192.168.1.5:40000", "", "10.8.0.1:52594", true},
+		// ... and later echoes must come from the learned source
+		{"192.168.1.5:40000", "10.8.0.1:52594", "10.8.0.1:52594", true},
+		{"192.168.1.5:40000", "10.8.0.1:52594", "[::ffff:10.8.0.1]:52594", true},
+		{"192.168.1.5:40000", "10.8.0.1:52594", "10.8.0.1:52595", false},
+		// no source reported
+		{"192.168.1.5:40000", "10.8.0.1:52594", "", true},
+	}
+	for _, tt := range tests {
+		tn := &Telnet7days{localAddr: tt.localAddr, source: tt.source}
+		if got := tn.fromOurSession(tt.echo); got != tt.want {
+			t.Errorf("local %s, source %q, echo %q: got %v, want %v", tt.localAddr, tt.source, tt.echo, got, tt.want)
+		}
+	}
+}
+
+// TestExecCrossTalk runs a batch behind NAT while another session, seen from
+// the same NAT address, runs the same command.
+func TestExecCrossTalk(t *testing.T) {
+	const (
+		ours   = "10.8.0.1:52594"
+		theirs = "10.8.0.1:52595"
+	)
+	server := telnettest.NewServer(t, nil)
+	calls := 0
+	server.HandleFunc("gt", func(c *telnettest.Conn, cmd string) error {
+		calls++
+		if calls > 1 {
+			c.Echo(cmd, theirs)
+			c.Println("Day 99, 00:00")
+		}
+		c.Echo(cmd, ours)
+		c.Println("Day 17, 15:27")
+		return nil
+	})
+	server.HandleFunc("noecho", func(c *telnettest.Conn, cmd string) error {
+		c.Echo(cmd, "")
+		c.Println("done")
+		return nil
+	})
+	res, err := newTestTelnet(server.Addr).ExecBatch([]string{"gt", "gt", "noecho"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"Day 17, 15:27", "Day 17, 15:27", "done"}
+	if !slices.Equal(res, want) {
+		t.Errorf("got %q, want %q", res, want)
+	}
+}
+
+// stallAfter answers lp with n player lines and then goes silent without the
+// "Total of" trailer.
+func stallAfter(n int) telnettest.Handler {
+	return func(c *telnettest.Conn, cmd string) error {
+		c.Echo(cmd, c.Source())
+		for i := 0; i < n; i++ {
+			c.Println(fmt.Sprintf("%d. id=%d, Player%d, pos=(1.0, 2.0, 3.0), level=5, pltfmid=Steam_7656119800000000%d", i, 171+i, i, i))
+		}
+		_, err := io.Copy(io.Discard, c)
+		return err
+	}
+}
+
+func TestGetPlayersPartial(t *testing.T) {
+	const n = 3
+	server := telnettest.NewServer(t, nil)
+	server.HandleFunc("lp", stallAfter(n))
+
+	for _, tt := range []struct {
+		name string
+		ctx  func() (context.Context, context.CancelFunc)
+		want error
+	}{
+		{"deadline", func() (context.Context, context.CancelFunc) {
+			return context.WithTimeout(context.Background(), 500*time.Millisecond)
+		}, context.DeadlineExceeded},
+		{"cancel", func() (context.Context, context.CancelFunc) {
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(500*time.Millisecond, cancel)
+			return ctx, cancel
+		}, context.Canceled},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := tt.ctx()
+			defer cancel()
+			players, err := newTestTelnet(server.Addr).GetPlayersContext(ctx)
+			if !errors.Is(err, ErrPartialPlayers) {
+				t.Errorf("err = %v, want ErrPartialPlayers", err)
+			}
+			if !errors.Is(err, tt.want) {
+				t.Errorf("err = %v, want %v", err, tt.want)
+			}
+			if len(players) != n {
+				t.Fatalf("got %d players, want %d", len(players), n)
+			}
+			for i, p := range players {
+				if want := fmt.Sprintf("Player%d", i); p.Name != want {
+					t.Errorf("players[%d].Name = %q, want %q", i, p.Name, want)
+				}
+			}
+		})
+	}
+}
+
+func TestDaysUntilBloodMoon(t *testing.T) {
+	want := []int{7, 6, 5, 4, 3, 2, 1, 0, 6, 5, 4, 3, 2, 1, 0, 6} // days 0..15
+	for day, w := range want {
+		for _, hours := range []int{0, 12, 23} {
+			g := GameTime{Days: day, Hours: hours}
+			if got := g.DaysUntilBloodMoon(7); got != w {
+				t.Errorf("day %d %02d:00: got %d, want %d", day, hours, got, w)
+			}
+		}
+	}
+	if got := (GameTime{Days: 3}).DaysUntilBloodMoon(0); got != 4 {
+		t.Errorf("cycle 0: got %d, want the default cycle's 4", got)
+	}
+	if got := (GameTime{Days: 3}).DaysUntilBloodMoon(5); got != 2 {
+		t.Errorf("cycle 5: got %d, want 2", got)
+	}
+}
+
+func TestIsBloodMoonNight(t *testing.T) {
+	tests := []struct {
+		g     GameTime
+		cycle int
+		want  bool
+	}{
+		{GameTime{Days: 7, Hours: 21, Minutes: 59}, 7, false},
+		{GameTime{Days: 7, Hours: 22}, 7, true},
+		{GameTime{Days: 7, Hours: 23}, 7, true},
+		{GameTime{Days: 8, Hours: 0}, 7, true},
+		{GameTime{Days: 8, Hours: 3, Minutes: 59}, 7, true},
+		{GameTime{Days: 8, Hours: 4}, 7, false},
+		{GameTime{Days: 1, Hours: 3}, 7, false},
+		{GameTime{Days: 5, Hours: 23}, 5, true},
+		{GameTime{Days: 7, Hours: 23}, 0, false},
+	}
+	for _, tt := range tests {
+		if got := tt.g.IsBloodMoonNight(tt.cycle); got != tt.want {
+			t.Errorf("%+v cycle %d: got %v, want %v", tt.g, tt.cycle, got, tt.want)
+		}
+	}
+	// Over days 0..15 only the nights of days 7 and 14 are blood moons.
+	for day := 0; day <= 15; day++ {
+		for hours := 0; hours < 24; hours++ {
+			g := GameTime{Days: day, Hours: hours}
+			want := (hours >= 22 && (day == 7 || day == 14)) ||
+				(hours < 4 && (day == 8 || day == 15))
+			if got := g.IsBloodMoonNight(7); got != want {
+				t.Errorf("day %d %02d:00: got %v, want %v", day, hours, got, want)
+			}
+		}
+	}
+}
+
+func TestParseBanLine(t *testing.T) {
+	until := time.Date(2024, 7, 7, 9, 57, 0, 0, time.Local)
+	tests := []struct {
+		line string
+		want Ban
+		ok   bool
+	}{
+		{"  2024-07-07 09:57:00 - Steam_76561198000000000 (PlayerName) - griefing\r", Ban{"Steam_76561198000000000", "PlayerName", until, "griefing"}, true},
+		{"  2024/07/07 09:57:00 - Steam_76561198000000000 (Player Name) - griefing, again", Ban{"Steam_76561198000000000", "Player Name", until, "griefing, again"}, true},
+		{"  07/07/2024 09:57:00 - EOS_0002d4e2a5f24a4c9b8d9b8c0e1f2a3b (PlayerName)", Ban{"EOS_0002d4e2a5f24a4c9b8d9b8c0e1f2a3b", "PlayerName", until, ""}, true},
+		{"  7/7/2024 9:57:00 AM - Steam_76561198000000000 - cheating", Ban{"Steam_76561198000000000", "", until, "cheating"}, true},
+		{"  7/7/2024 9:57:00 PM - Steam_76561198000000000", Ban{"Steam_76561198000000000", "", until.Add(12 * time.Hour), ""}, true},
+		{"  2024-07-07T09:57:00Z - Steam_76561198000000000 (PlayerName) - griefing", Ban{"Steam_76561198000000000", "PlayerName", time.Date(2024, 7, 7, 9, 57, 0, 0, time.UTC), "griefing"}, true},
+		{"  Banned until - UserID (name) - Reason", Ban{}, false},
+		{"Ban list entries:", Ban{}, false},
+		{"next week - Steam_76561198000000000 (PlayerName) - griefing", Ban{}, false},
+		{"", Ban{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseBanLine(tt.line)
+		if ok != tt.ok || got.ID != tt.want.ID || got.Name != tt.want.Name ||
+			!got.Until.Equal(tt.want.Until) || got.Reason != tt.want.Reason {
+			t.Errorf("%q: got %+v, %v, want %+v, %v", tt.line, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestParseBans(t *testing.T) {
+	// See the "ban list" sample next to BanRemove.
+	out := "Ban list entries:\n" +
+		"  Banned until - UserID (name) - Reason\n" +
+		"  2024-07-07 09:57:00 - Steam_76561198000000000 (PlayerName) - griefing\n" +
+		"  2024-08-01 00:00:00 - Steam_76561198000000001 (Other) - "
+	bans := parseBans(out)
+	var ids []string
+	for _, ban := range bans {
+		ids = append(ids, ban.ID)
+	}
+	if want := []string{"Steam_76561198000000000", "Steam_76561198000000001"}; !slices.Equal(ids, want) {
+		t.Errorf("got %q, want %q", ids, want)
+	}
+
+	empty := "Ban list entries:\n  Banned until - UserID (name) - Reason"
+	if bans := parseBans(empty); bans == nil || len(bans) != 0 {
+		t.Errorf("empty list: got %#v, want an empty slice", bans)
+	}
+	if bans := parseBans(""); bans == nil || len(bans) != 0 {
+		t.Errorf("no output: got %#v, want an empty slice", bans)
+	}
+}
+
+func TestParseAdmins(t *testing.T) {
+	tests := []struct {
+		name string
+		out  string
+		want []Admin
+	}{
+		{
+			// See the "admin list" sample next to GetAdmins.
+			name: "sample",
+			out: "Defined User Permissions:\n" +
+				"  0: Steam_76561198000000000 (PlayerName)\n" +
+				"Defined Group Permissions:",
+			want: []Admin{{ID: "Steam_76561198000000000", Name: "PlayerName", Level: 0}},
+		},
+		{
+			name: "no admins",
+			out:  "Defined User Permissions:\nDefined Group Permissions:",
+			want: []Admin{},
+		},
+		{
+			name: "bare ids and groups",
+			out: "Defined User Permissions:\r\n" +
+				"  0: 76561198000000001 (Owner Name)\r\n" +
+				"  1: EOS_0002d4e2a5f24a4c9b8d9b8c0e1f2a3b\r\n" +
+				"  1000: Steam_76561198000000002 (Guest)\r\n" +
+				"Defined Group Permissions:\r\n" +
+				"  0: Steam_103582791400000000 (Mods)\r\n",
+			want: []Admin{
+				{ID: "76561198000000001", Name: "Owner Name", Level: 0},
+				{ID: "EOS_0002d4e2a5f24a4c9b8d9b8c0e1f2a3b", Name: "", Level: 1},
+				{ID: "Steam_76561198000000002", Name: "Guest", Level: 1000},
+			},
+		},
+		{
+			name: "no output",
+			out:  "",
+			want: []Admin{},
+		},
+	}
+	for _, tt := range tests {
+		got := parseAdmins(tt.out)
+		if got == nil || !slices.Equal(got, tt.want) {
+			t.Errorf("%s: got %#v, want %#v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+// Package telnettest provides a fake 7 Days to Die telnet server for tests.
+package telnettest
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Handler answers a command on c. It is responsible for writing the command
+// echo. Returning an error drops the connection.
+type Handler func(c *Conn, cmd string) error
+
+// Server is a fake telnet server. Set the fields before calling Start.
+type Server struct {
+	Addr string
+
+	// Banner is sent before the password prompt.
+	Banner []string
+	// PromptDelay is how long the server waits after the banner before
+	// prompting. Anything the client sends meanwhile is recorded and fails
+	// the login; see Early.
+	PromptDelay time.Duration
+	Prompt      string // default "Please enter password:"
+	Password    string // default "secret"
+	LoginOK     string // default "Logon successful."
+
+	mu       sync.Mutex
+	handlers map[string]Handler
+	down     bool
+	early    []string
+}
+
+// Start listens on a local port and serves until the test ends.
+func (s *Server) Start(t testing.TB) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	s.Addr = ln.Addr().String()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(&Conn{Conn: conn})
+		}
+	}()
+}
+
+// NewServer starts a server answering each command in outputs with the
+// command echo followed by the given lines.
+func NewServer(t testing.TB, outputs map[string][]string) *Server {
+	s := &Server{}
+	for cmd, lines := range outputs {
+		s.Handle(cmd, lines...)
+	}
+	s.Start(t)
+	return s
+}
+
+// Handle answers cmd with its echo followed by lines.
+func (s *Server) Handle(cmd string, lines ...string) {
+	s.HandleFunc(cmd, func(c *Conn, cmd string) error {
+		c.Echo(cmd, c.Source())
+		c.Println(lines...)
+		return nil
+	})
+}
+
+// HandleFunc answers cmd with h.
+func (s *Server) HandleFunc(cmd string, h Handler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.handlers == nil {
+		s.handlers = map[string]Handler{}
+	}
+	s.handlers[cmd] = h
+}
+
+// SetDown makes the server close new connections right away, as if the game
+// server was stopped.
+func (s *Server) SetDown(down bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.down = down
+}
+
+// Early returns the lines clients sent before being prompted.
+func (s *Server) Early() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.early...)
+}
+
+func (s *Server) handler(cmd string) Handler {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if h, ok := s.handlers[cmd]; ok {
+		return h
+	}
+	return func(c *Conn, cmd string) error {
+		c.Echo(cmd, c.Source())
+		return nil
+	}
+}
+
+func or(v, def string) string {
+	if v == "" {
+		return def
+	}
+	return v
+}
+
+func (s *Server) serve(c *Conn) {
+	defer c.Close()
+	s.mu.Lock()
+	down := s.down
+	s.mu.Unlock()
+	if down {
+		return
+	}
+	r := bufio.NewReader(c)
+	c.Println(s.Banner...)
+	if s.PromptDelay > 0 {
+		c.SetReadDeadline(time.Now().Add(s.PromptDelay))
+		if line, err := r.ReadString('\n'); err == nil {
+			s.mu.Lock()
+			s.early = append(s.early, strings.TrimSpace(line))
+			s.mu.Unlock()
+			return
+		}
+		c.SetReadDeadline(time.Time{})
+	}
+	c.Println(or(s.Prompt, "Please enter password:"))
+	pass, err := r.ReadString('\n')
+	if err != nil {
+		return
+	}
+	if strings.TrimSpace(pass) != or(s.Password, "secret") {
+		c.Println("Password incorrect, please enter password:")
+		return
+	}
+	c.Println(or(s.LoginOK, "Logon successful."))
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.TrimSpace(line)
+		if cmd == "exit" {
+			return
+		}
+		if err := s.handler(cmd)(c, cmd); err != nil {
+			return
+		}
+	}
+}
+
+// Conn is a client session of the fake server.
+type Conn struct {
+	net.Conn
+}
+
+// Source returns the client address the server reports in command echoes.
+func (c *Conn) Source() string {
+	return c.RemoteAddr().String()
+}
+
+// Echo writes the server's echo of cmd run from source. An empty source
+// writes the echo of older servers, which don't report it.
+func (c *Conn) Echo(cmd, source string) {
+	c.Println(Echo(cmd, source))
+}
+
+// Println writes lines terminated by CRLF.
+func (c *Conn) Println(lines ...string) {
+	for _, line := range lines {
+		fmt.Fprintf(c, "%s\r\n", line)
+	}
+}
+
+// Echo returns the log line the server prints when a telnet session runs
+// cmd from source. An empty source omits the " from" part.
+func Echo(cmd, source string) string {
+	line := fmt.Sprintf("2024-06-30T09:56:10 17457.102 INF Executing command '%s' by Telnet", cmd)
+	if source != "" {
+		line += " from " + source
+	}
+	return line
+}
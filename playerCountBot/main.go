@@ -1,8 +1,18 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"math/rand"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/bwmarrin/discordgo"
@@ -13,14 +23,69 @@ import (
 type env struct {
 	telnet.Env
 	// Discord
-	DiscordToken    string `envconfig:"DISCORD_TOKEN"`
-	DiscordServerID string `envconfig:"DISCORD_SERVER_ID"`
+	DiscordToken     string   `envconfig:"DISCORD_TOKEN"`
+	DiscordServerIDs []string `envconfig:"DISCORD_SERVER_ID"` // comma separated
+	// Alerts posted to ALERT_CHANNEL_ID
+	AlertChannelIDs  []string      `envconfig:"ALERT_CHANNEL_ID"`            // comma separated
+	HordeThreshold   int           `envconfig:"HORDE_THRESHOLD" default:"0"` // 0 disables
+	HordeDelta       int           `envconfig:"HORDE_DELTA" default:"0"`     // 0 disables
+	HordeNightOnly   bool          `envconfig:"HORDE_NIGHT_ONLY" default:"false"`
+	HordeAlertPeriod time.Duration `envconfig:"HORDE_ALERT_PERIOD" default:"10m"`
+	BloodMoonCycle   int           `envconfig:"BLOOD_MOON_CYCLE" default:"0"` // 0 reads BloodMoonFrequency from the server
+	BloodMoonAlert   bool          `envconfig:"BLOOD_MOON_ALERT" default:"true"`
+	EmojiZombie      string        `envconfig:"EMOJI_ZOMBIE" default:"🧟"`
+	EmojiBloodMoon   string        `envconfig:"EMOJI_BLOODMOON" default:"🌅"`
+	// Nickname and activity
+	NicknameEnabled  bool   `envconfig:"NICKNAME_ENABLED" default:"true"`
+	NicknameTemplate string `envconfig:"NICKNAME_TEMPLATE" default:"Day{day}, {hour}:{minute}"`
+	ActivityTemplate string `envconfig:"ACTIVITY_TEMPLATE" default:"プレイヤー{players}人"`
+	OfflineNickname  string `envconfig:"OFFLINE_NICKNAME" default:"OFFLINE"` // empty keeps the last nickname
+	MaxPlayers       int    `envconfig:"MAX_PLAYERS" default:"0"`            // 0 disables the (FULL) mark
+	// Display the max count over this many ticks, 1 disables smoothing
+	PlayerCountWindow int `envconfig:"PLAYER_COUNT_WINDOW" default:"1"`
+	// Push notifications are suppressed during QUIET_HOURS ("23:00-07:00")
+	QuietHours   string `envconfig:"QUIET_HOURS"`
+	QuietHoursTZ string `envconfig:"QUIET_HOURS_TZ" default:"Local"`
+	// Wait up to WARMUP_TIMEOUT for the server on startup, 0 disables
+	WarmupTimeout time.Duration `envconfig:"WARMUP_TIMEOUT" default:"0"`
+	// Status left on shutdown, empty to leave the last status
+	ShutdownStatus string `envconfig:"SHUTDOWN_STATUS" default:"ボット停止中"`
+}
+
+// session is the subset of *discordgo.Session used by the bot, so a fake can
+// be injected in tests.
+type session interface {
+	UpdateCustomStatus(state string) error
+	UpdateGameStatus(idle int, name string) error
+	GuildMemberNickname(guildID, userID, nickname string, options ...discordgo.RequestOption) error
+	ChannelMessageSend(channelID string, content string, options ...discordgo.RequestOption) (*discordgo.Message, error)
 }
 
 type discordbot struct {
 	env
-	s *discordgo.Session
-	t *telnet.Telnet7days
+	s     session
+	t     *telnet.Telnet7days
+	ctx   context.Context
+	wg    sync.WaitGroup
+	quiet *quietHours
+
+	loopOnce sync.Once
+	mu       sync.Mutex // guards s and the tick state below
+
+	nicknameFailed map[string]bool // by guild id
+	lastActivity   string
+	offline        bool
+	recentCounts   []int
+	prevZombies    int
+	hasPrevZombies bool
+	hordeActive    bool
+	lastHordeAlert time.Time
+	// bloodMoonActive is whether the previous tick was in a blood moon night
+	bloodMoonActive bool
+	// serverCycle is the server's BloodMoonFrequency, 0 until read
+	serverCycle int
+	// cycleRetryAt is when a failed BloodMoonFrequency lookup is retried
+	cycleRetryAt time.Time
 }
 
 /*
@@ -58,16 +123,26 @@ func (d *discordbot) getGameStatus() (GameStatus, error) {
 func main() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 	e := env{}
-	envconfig.Process("", &e)
+	if err := envconfig.Process("", &e); err != nil {
+		log.Fatal(err)
+	}
 	dg, err := discordgo.New("Bot " + e.DiscordToken)
 	if err != nil {
 		fmt.Println("error creating Discord session,", err)
 		return
 	}
 
+	quiet, err := parseQuietHours(e.QuietHours, e.QuietHoursTZ)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 	d := &discordbot{
-		env: e,
-		t:   &telnet.Telnet7days{Env: e.Env},
+		env:   e,
+		t:     &telnet.Telnet7days{Env: e.Env},
+		ctx:   ctx,
+		quiet: quiet,
 	}
 	dg.AddHandler(d.ready)
 	err = dg.Open()
@@ -77,34 +152,342 @@ func main() {
 	}
 	defer dg.Close()
 
-	select {}
+	<-ctx.Done()
+	log.Println("Shutting down")
+	d.shutdown()
+}
+
+// shutdown waits for the update loop to stop and leaves ShutdownStatus as
+// the bot's status so it doesn't keep showing stale game info.
+func (d *discordbot) shutdown() {
+	d.wg.Wait()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.s == nil || d.ShutdownStatus == "" {
+		return
+	}
+	if err := d.s.UpdateCustomStatus(d.ShutdownStatus); err != nil {
+		log.Printf("Error updating status: %s", err)
+	}
 }
 
+const (
+	updateInterval    = 30 * time.Second
+	maxUpdateInterval = 10 * time.Minute
+	// cycleRetryInterval is how long a failed BloodMoonFrequency lookup
+	// is not retried.
+	cycleRetryInterval = 10 * time.Minute
+)
+
+// ready is called on every (re)connect; the update loop is only started
+// once.
 func (d *discordbot) ready(s *discordgo.Session, event *discordgo.Ready) {
+	d.connected(s)
+	d.loopOnce.Do(func() {
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+			d.loop()
+		}()
+	})
+}
+
+// connected switches to the (re)connected session. Discord drops the
+// presence on reconnect, so the activity is sent again on the next update.
+func (d *discordbot) connected(s session) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 	d.s = s
-	d.update()
-	ticker := time.NewTicker(30 * time.Second)
-	go func() {
-		for range ticker.C {
-			d.update()
+	d.lastActivity = ""
+}
+
+// loop runs update periodically until d.ctx is done, backing off while the
+// game server keeps failing and returning to the normal interval on the
+// first success.
+func (d *discordbot) loop() {
+	if d.WarmupTimeout > 0 {
+		ctx, cancel := context.WithTimeout(d.ctx, d.WarmupTimeout)
+		if err := d.t.WaitReady(ctx, time.Minute); err != nil {
+			log.Printf("Server not reachable yet: %s", err)
+		} else {
+			log.Printf("Server %s is reachable", d.ServerAddr)
+		}
+		cancel()
+	}
+	if v, err := d.t.GetVersion(); err != nil {
+		log.Printf("Error getting server version: %s", err)
+	} else {
+		log.Printf("Game server version: %s (%s)", v.Game, v.Build)
+	}
+	failures := 0
+	for {
+		if err := d.update(); err != nil {
+			failures++
+			if failures == 1 {
+				log.Printf("Error updating status: %s", err)
+			}
+		} else {
+			if failures > 0 {
+				log.Printf("Server recovered after %d failures", failures)
+			}
+			failures = 0
+		}
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-time.After(nextInterval(failures)):
 		}
-	}()
+	}
+}
+
+// nextInterval doubles updateInterval for each consecutive failure up to
+// maxUpdateInterval, adding up to 20% jitter while backing off.
+func nextInterval(failures int) time.Duration {
+	if failures == 0 {
+		return updateInterval
+	}
+	interval := updateInterval
+	for i := 0; i < failures && interval < maxUpdateInterval; i++ {
+		interval *= 2
+	}
+	if interval > maxUpdateInterval {
+		interval = maxUpdateInterval
+	}
+	return interval + time.Duration(rand.Int63n(int64(interval/5)))
+}
+
+// expandTemplate fills the NICKNAME_TEMPLATE/ACTIVITY_TEMPLATE placeholders:
+// {day}, {hour}, {minute} (zero padded) and {players}.
+func expandTemplate(tmpl string, day telnet.GameTime, players int) string {
+	return strings.NewReplacer(
+		"{day}", strconv.Itoa(day.Days),
+		"{hour}", fmt.Sprintf("%02d", day.Hours),
+		"{minute}", fmt.Sprintf("%02d", day.Minutes),
+		"{players}", strconv.Itoa(players),
+	).Replace(tmpl)
+}
+
+// setOffline shows the server as stopped. Discord is only updated on the
+// transition to offline; the regular status and nickname come back with the
+// first successful update.
+func (d *discordbot) setOffline() {
+	if d.offline {
+		return
+	}
+	d.offline = true
+	// Counts from before the outage must not hold up the count afterwards.
+	d.recentCounts = nil
+	d.s.UpdateCustomStatus("サーバ停止中")
+	d.lastActivity = ""
+	if d.NicknameEnabled && d.OfflineNickname != "" {
+		d.updateNickname(d.OfflineNickname)
+	}
+}
+
+// failed handles a failed server query. A query aborted by shutdown says
+// nothing about the server, so the bot is only shown offline for other
+// errors.
+func (d *discordbot) failed(err error) error {
+	if d.ctx.Err() != nil {
+		return d.ctx.Err()
+	}
+	d.setOffline()
+	return err
 }
 
-func (d *discordbot) update() {
-	day, err := d.t.GetTime()
+// smoothCount records the online count and returns the maximum over the
+// last PLAYER_COUNT_WINDOW ticks, so a brief disconnect doesn't flicker the
+// displayed count.
+func (d *discordbot) smoothCount(count int) int {
+	d.recentCounts = append(d.recentCounts, count)
+	if n := max(d.PlayerCountWindow, 1); len(d.recentCounts) > n {
+		d.recentCounts = d.recentCounts[len(d.recentCounts)-n:]
+	}
+	return slices.Max(d.recentCounts)
+}
+
+// updateNickname sets the bot's nickname in every configured guild. A
+// failure, typically a missing nickname permission, is logged once per guild
+// until the next success and doesn't affect the other guilds.
+func (d *discordbot) updateNickname(nick string) {
+	if d.nicknameFailed == nil {
+		d.nicknameFailed = map[string]bool{}
+	}
+	for _, guildID := range d.DiscordServerIDs {
+		if err := d.s.GuildMemberNickname(guildID, "@me", nick); err != nil {
+			if !d.nicknameFailed[guildID] {
+				log.Printf("Error updating nickname in %s (suppressing until it succeeds): %s", guildID, err)
+			}
+			d.nicknameFailed[guildID] = true
+			continue
+		}
+		d.nicknameFailed[guildID] = false
+	}
+}
+
+// notify posts msg to every alert channel, unless it is quiet hours.
+func (d *discordbot) notify(msg string, now time.Time) {
+	if d.quiet.contains(now) {
+		log.Printf("Notification suppressed during quiet hours: %s", msg)
+		return
+	}
+	for _, channelID := range d.AlertChannelIDs {
+		if _, err := d.s.ChannelMessageSend(channelID, msg); err != nil {
+			log.Printf("Error sending notification to %s: %s", channelID, err)
+		}
+	}
+}
+
+// update refreshes the bot status. Calls are serialized by d.mu, which
+// guards the session and the state tracked across ticks. Server queries are
+// aborted when d.ctx is done, so a hung server doesn't hold up shutdown.
+func (d *discordbot) update() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	day, err := d.t.GetTimeContext(d.ctx)
 	if err != nil {
-		d.s.UpdateCustomStatus("サーバ停止中")
+		return d.failed(err)
+	}
+	players, err := d.t.GetPlayersContext(d.ctx)
+	switch {
+	case err == nil:
+	case errors.Is(err, telnet.ErrPartialPlayers) && d.ctx.Err() == nil:
+		// The server answered, just slowly; count whoever made it.
+		log.Printf("Using partial player list (%d players): %s", len(players), err)
+	default:
+		return d.failed(err)
+	}
+	d.offline = false
+	count := d.smoothCount(len(players))
+	if d.NicknameEnabled {
+		d.updateNickname(expandTemplate(d.NicknameTemplate, day, count))
+	}
+	activity := expandTemplate(d.ActivityTemplate, day, count)
+	if d.MaxPlayers > 0 && count >= d.MaxPlayers {
+		activity += " (FULL)"
+	}
+	if activity != d.lastActivity {
+		d.s.UpdateGameStatus(0, activity)
+		d.lastActivity = activity
+	}
+	if len(d.AlertChannelIDs) > 0 {
+		d.checkBloodMoon(day, len(players), time.Now())
+		mem, err := d.t.GetMemContext(d.ctx)
+		if err != nil {
+			log.Printf("Error getting hostiles: %s", err)
+			return nil
+		}
+		d.checkHorde(day, mem.Zombies, time.Now())
+	}
+	return nil
+}
+
+// checkBloodMoon announces once per cycle when a blood moon night ends,
+// unless BLOOD_MOON_ALERT is off.
+func (d *discordbot) checkBloodMoon(day telnet.GameTime, players int, now time.Time) {
+	if !d.BloodMoonAlert {
 		return
 	}
-	players, err := d.t.GetPlayers()
+	active := day.IsBloodMoonNight(d.bloodMoonCycle(now))
+	ended := d.bloodMoonActive && !active
+	d.bloodMoonActive = active
+	if ended {
+		d.notify(fmt.Sprintf("%s ブラッドムーンを乗り越えました！ %d人が生還", d.EmojiBloodMoon, players), now)
+	}
+}
+
+// bloodMoonCycle returns BLOOD_MOON_CYCLE, or the server's BloodMoonFrequency
+// when unset, like the agent. A failed lookup falls back to the default and
+// is retried after cycleRetryInterval, so a server without getgamepref isn't
+// asked on every tick.
+func (d *discordbot) bloodMoonCycle(now time.Time) int {
+	if d.BloodMoonCycle > 0 {
+		return d.BloodMoonCycle
+	}
+	if d.serverCycle == 0 {
+		if now.Before(d.cycleRetryAt) {
+			return telnet.DefaultBloodMoonCycle
+		}
+		cycle, err := d.t.GetBloodMoonCycleContext(d.ctx)
+		if err != nil {
+			log.Printf("Error getting BloodMoonFrequency, assuming %d: %s", telnet.DefaultBloodMoonCycle, err)
+			d.cycleRetryAt = now.Add(cycleRetryInterval)
+			return telnet.DefaultBloodMoonCycle
+		}
+		d.serverCycle = cycle
+	}
+	return d.serverCycle
+}
+
+// quietHours is a daily time range, which may wrap past midnight.
+type quietHours struct {
+	start, end int // minutes since midnight
+	loc        *time.Location
+}
+
+// parseQuietHours parses a "HH:MM-HH:MM" range in the tz location. An empty
+// spec returns nil, which never contains any time.
+func parseQuietHours(spec, tz string) (*quietHours, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	loc, err := time.LoadLocation(tz)
 	if err != nil {
-		d.s.UpdateCustomStatus("サーバ停止中")
+		return nil, fmt.Errorf("invalid QUIET_HOURS_TZ: %v", err)
+	}
+	bounds := strings.Split(spec, "-")
+	if len(bounds) != 2 {
+		return nil, fmt.Errorf("invalid QUIET_HOURS '%s': want HH:MM-HH:MM", spec)
+	}
+	var minutes [2]int
+	for i, bound := range bounds {
+		t, err := time.Parse("15:04", bound)
+		if err != nil {
+			return nil, fmt.Errorf("invalid QUIET_HOURS '%s': %v", spec, err)
+		}
+		minutes[i] = t.Hour()*60 + t.Minute()
+	}
+	return &quietHours{start: minutes[0], end: minutes[1], loc: loc}, nil
+}
+
+func (q *quietHours) contains(t time.Time) bool {
+	if q == nil {
+		return false
+	}
+	t = t.In(q.loc)
+	m := t.Hour()*60 + t.Minute()
+	if q.start <= q.end {
+		return q.start <= m && m < q.end
+	}
+	return m >= q.start || m < q.end
+}
+
+// isNight reports whether the game time is within the default 7dtd night
+// (22:00-04:00).
+func isNight(day telnet.GameTime) bool {
+	return day.Hours >= 22 || day.Hours < 4
+}
+
+// checkHorde posts an alert when the hostile count exceeds HordeThreshold or
+// grows by HordeDelta since the previous tick. A sustained horde alerts once,
+// and alerts are spaced at least HordeAlertPeriod apart.
+func (d *discordbot) checkHorde(day telnet.GameTime, zombies int, now time.Time) {
+	delta := zombies - d.prevZombies
+	spike := (d.HordeThreshold > 0 && zombies >= d.HordeThreshold) ||
+		(d.HordeDelta > 0 && d.hasPrevZombies && delta >= d.HordeDelta)
+	d.prevZombies = zombies
+	d.hasPrevZombies = true
+	if d.HordeNightOnly && !isNight(day) {
+		spike = false
+	}
+	if !spike {
+		d.hordeActive = false
 		return
 	}
-	if err := d.s.GuildMemberNickname(d.DiscordServerID, "@me", fmt.Sprintf("Day%d, %02d:%02d",
-		day.Days, day.Hours, day.Minutes)); err != nil {
-		log.Printf("Error updating nickname: %s", err)
+	if d.hordeActive || now.Sub(d.lastHordeAlert) < d.HordeAlertPeriod {
+		return
 	}
-	d.s.UpdateGameStatus(0, fmt.Sprintf("プレイヤー%d人", len(players)))
+	d.hordeActive = true
+	d.lastHordeAlert = now
+	d.notify(fmt.Sprintf("%s ゾンビが急増しています: %d体 (%+d)", d.EmojiZombie, zombies, delta), now)
 }
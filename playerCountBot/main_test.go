@@ -0,0 +1,389 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/masahide/mackerel-7dtd/pkg/telnet"
+	"github.com/masahide/mackerel-7dtd/pkg/telnet/telnettest"
+)
+
+// fakeSession records the Discord calls made by the bot.
+type fakeSession struct {
+	mu       sync.Mutex
+	statuses []string // custom and game statuses in call order
+	nicks    []string
+	messages []string
+}
+
+func (f *fakeSession) UpdateCustomStatus(state string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.statuses = append(f.statuses, state)
+	return nil
+}
+
+func (f *fakeSession) UpdateGameStatus(idle int, name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.statuses = append(f.statuses, name)
+	return nil
+}
+
+func (f *fakeSession) GuildMemberNickname(guildID, userID, nickname string, options ...discordgo.RequestOption) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nicks = append(f.nicks, nickname)
+	return nil
+}
+
+func (f *fakeSession) ChannelMessageSend(channelID string, content string, options ...discordgo.RequestOption) (*discordgo.Message, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.messages = append(f.messages, content)
+	return &discordgo.Message{Content: content}, nil
+}
+
+func (f *fakeSession) lastStatus() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.statuses) == 0 {
+		return ""
+	}
+	return f.statuses[len(f.statuses)-1]
+}
+
+func (f *fakeSession) lastNick() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.nicks) == 0 {
+		return ""
+	}
+	return f.nicks[len(f.nicks)-1]
+}
+
+// startFakeServer starts a telnet server answering gt, lp and mem.
+func startFakeServer(t *testing.T) *telnettest.Server {
+	server := telnettest.NewServer(t, map[string][]string{
+		"gt":  {"Day 17, 15:27"},
+		"mem": {"2024-06-30T09:56:10 17457.103 INF Time: 290.77m FPS: 37.02 Heap: 2173.9MB Max: 2766.2MB Chunks: 529 CGO: 24 Ply: 1 Zom: 8 Ent: 19 (173) Items: 0 CO: 2 RSS: 5731.27MB"},
+	})
+	setPlayers(server, 0)
+	return server
+}
+
+// setPlayers makes lp list n players.
+func setPlayers(server *telnettest.Server, n int) {
+	lines := []string{}
+	for i := 0; i < n; i++ {
+		lines = append(lines, fmt.Sprintf("%d. id=%d, Player%d, pos=(1.0, 2.0, 3.0), level=1, pltfmid=Steam_7656119800000000%d, ping=20", i, 171+i, i, i))
+	}
+	server.Handle("lp", append(lines, fmt.Sprintf("Total of %d in the game", n))...)
+}
+
+func newTestBot(ctx context.Context, s session, addr string) *discordbot {
+	return &discordbot{
+		env: env{
+			Env: telnet.Env{
+				ServerAddr:          addr,
+				TelnetPass:          "secret",
+				TelnetPromptMarkers: []string{"password"},
+			},
+			DiscordServerIDs:  []string{"guild1"},
+			BloodMoonCycle:    7,
+			BloodMoonAlert:    true,
+			NicknameEnabled:   true,
+			NicknameTemplate:  "Day{day}, {hour}:{minute}",
+			ActivityTemplate:  "{players} players",
+			OfflineNickname:   "OFFLINE",
+			PlayerCountWindow: 3,
+			ShutdownStatus:    "stopped",
+		},
+		s:   s,
+		t:   &telnet.Telnet7days{Env: telnet.Env{ServerAddr: addr, TelnetPass: "secret", TelnetPromptMarkers: []string{"password"}}},
+		ctx: ctx,
+	}
+}
+
+// TestUpdateDuringShutdown runs updates concurrently with shutdown; run with
+// -race. The shutdown status must be the last one set, and updates aborted by
+// the shutdown must not show the server as offline.
+func TestUpdateDuringShutdown(t *testing.T) {
+	for _, cancelled := range []bool{false, true} {
+		server := startFakeServer(t)
+		setPlayers(server, 2)
+		s := &fakeSession{}
+		ctx, cancel := context.WithCancel(context.Background())
+		d := newTestBot(ctx, s, server.Addr)
+		if cancelled {
+			cancel()
+		}
+		for i := 0; i < 4; i++ {
+			// Take the server down halfway so both the online and the
+			// offline status race with shutdown.
+			if i == 2 && !cancelled {
+				server.SetDown(true)
+			}
+			d.wg.Add(1)
+			go func() {
+				defer d.wg.Done()
+				d.update()
+			}()
+		}
+		d.shutdown()
+		cancel()
+		if got := s.lastStatus(); got != "stopped" {
+			t.Errorf("cancelled=%v: last status = %q, want stopped", cancelled, got)
+		}
+		if cancelled {
+			if len(s.statuses) != 1 || len(s.nicks) != 0 {
+				t.Errorf("cancelled: statuses %q, nicknames %q, want only the shutdown status", s.statuses, s.nicks)
+			}
+		}
+	}
+}
+
+func TestParseQuietHours(t *testing.T) {
+	tests := []struct {
+		spec    string
+		start   int
+		end     int
+		wantErr bool
+	}{
+		{"23:00-07:00", 23 * 60, 7 * 60, false},
+		{"01:30-06:15", 90, 375, false},
+		{"7:00-9:05", 420, 545, false},
+		{"00:00-00:00", 0, 0, false},
+		{"23:00x-07:00", 0, 0, true},
+		{"23:00-07:00x", 0, 0, true},
+		{"24:00-07:00", 0, 0, true},
+		{"23:60-07:00", 0, 0, true},
+		{"23:00", 0, 0, true},
+		{"23:00-07:00-08:00", 0, 0, true},
+		{"-1:00-07:00", 0, 0, true},
+	}
+	for _, tt := range tests {
+		q, err := parseQuietHours(tt.spec, "UTC")
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%q: got %+v, want error", tt.spec, q)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.spec, err)
+			continue
+		}
+		if q.start != tt.start || q.end != tt.end {
+			t.Errorf("%q: got %d-%d, want %d-%d", tt.spec, q.start, q.end, tt.start, tt.end)
+		}
+	}
+}
+
+func TestQuietHoursContains(t *testing.T) {
+	tests := []struct {
+		spec string
+		at   string
+		want bool
+	}{
+		// wrapping past midnight
+		{"23:00-07:00", "22:59", false},
+		{"23:00-07:00", "23:00", true},
+		{"23:00-07:00", "00:00", true},
+		{"23:00-07:00", "06:59", true},
+		{"23:00-07:00", "07:00", false},
+		{"23:00-07:00", "12:00", false},
+		// within a day
+		{"01:00-06:00", "00:59", false},
+		{"01:00-06:00", "01:00", true},
+		{"01:00-06:00", "05:59", true},
+		{"01:00-06:00", "06:00", false},
+	}
+	for _, tt := range tests {
+		q, err := parseQuietHours(tt.spec, "UTC")
+		if err != nil {
+			t.Fatal(err)
+		}
+		at, err := time.Parse("15:04", tt.at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := q.contains(at); got != tt.want {
+			t.Errorf("%q contains %s = %v, want %v", tt.spec, tt.at, got, tt.want)
+		}
+	}
+	var none *quietHours
+	if none.contains(time.Now()) {
+		t.Error("nil quiet hours contains now")
+	}
+}
+
+func TestOfflineToOnline(t *testing.T) {
+	server := startFakeServer(t)
+	s := &fakeSession{}
+	d := newTestBot(context.Background(), s, server.Addr)
+
+	steps := []struct {
+		down    bool
+		players int
+		wantErr bool
+		nick    string
+		status  string
+	}{
+		{false, 2, false, "Day17, 15:27", "2 players"},
+		{true, 0, true, "OFFLINE", "サーバ停止中"},
+		{true, 0, true, "OFFLINE", "サーバ停止中"},
+		// The count before the outage is not carried over by smoothing.
+		{false, 1, false, "Day17, 15:27", "1 players"},
+	}
+	for i, step := range steps {
+		server.SetDown(step.down)
+		setPlayers(server, step.players)
+		err := d.update()
+		if (err != nil) != step.wantErr {
+			t.Errorf("step %d: err = %v, want error %v", i, err, step.wantErr)
+		}
+		if got := s.lastNick(); got != step.nick {
+			t.Errorf("step %d: nickname = %q, want %q", i, got, step.nick)
+		}
+		if got := s.lastStatus(); got != step.status {
+			t.Errorf("step %d: status = %q, want %q", i, got, step.status)
+		}
+	}
+	if n := len(s.statuses); n != 3 {
+		t.Errorf("status updated %d times, want 3: %q", n, s.statuses)
+	}
+}
+
+// TestPartialPlayers stalls lp after one of two players until the session
+// deadline passes. The bot must keep the server online with the partial list.
+func TestPartialPlayers(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for the telnet session deadline")
+	}
+	server := startFakeServer(t)
+	s := &fakeSession{}
+	d := newTestBot(context.Background(), s, server.Addr)
+
+	setPlayers(server, 2)
+	if err := d.update(); err != nil {
+		t.Fatal(err)
+	}
+	server.HandleFunc("lp", func(c *telnettest.Conn, cmd string) error {
+		c.Echo(cmd, c.Source())
+		c.Println("0. id=171, Player0, pos=(1.0, 2.0, 3.0), level=1, pltfmid=Steam_76561198000000000, ping=20")
+		_, err := io.Copy(io.Discard, c)
+		return err
+	})
+	if err := d.update(); err != nil {
+		t.Errorf("update with a partial list: %v", err)
+	}
+	if d.offline {
+		t.Error("server shown offline after a partial player list")
+	}
+	if got := s.lastNick(); got != "Day17, 15:27" {
+		t.Errorf("nickname = %q, want %q", got, "Day17, 15:27")
+	}
+	if want := []int{2, 1}; !slices.Equal(d.recentCounts, want) {
+		t.Errorf("recentCounts = %v, want %v", d.recentCounts, want)
+	}
+}
+
+func TestCheckBloodMoon(t *testing.T) {
+	night := []telnet.GameTime{
+		{Days: 7, Hours: 21}, {Days: 7, Hours: 23}, {Days: 8, Hours: 3}, {Days: 8, Hours: 4}, {Days: 8, Hours: 5},
+	}
+	for _, enabled := range []bool{true, false} {
+		s := &fakeSession{}
+		d := newTestBot(context.Background(), s, "127.0.0.1:1")
+		d.AlertChannelIDs = []string{"alerts"}
+		d.BloodMoonAlert = enabled
+		for _, day := range night {
+			d.checkBloodMoon(day, 2, time.Now())
+		}
+		want := 0
+		if enabled {
+			want = 1
+		}
+		if len(s.messages) != want {
+			t.Errorf("BloodMoonAlert %v: got %q, want %d message", enabled, s.messages, want)
+		}
+	}
+}
+
+// TestBloodMoonCycleRetry checks that a failed BloodMoonFrequency lookup is
+// not repeated on every tick.
+func TestBloodMoonCycleRetry(t *testing.T) {
+	server := startFakeServer(t)
+	var mu sync.Mutex
+	calls := 0
+	frequency := "" // no answer until set
+	server.HandleFunc("getgamepref", func(c *telnettest.Conn, cmd string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		c.Echo(cmd, c.Source())
+		if frequency != "" {
+			c.Println("GamePref.BloodMoonFrequency = " + frequency)
+		}
+		return nil
+	})
+	d := newTestBot(context.Background(), &fakeSession{}, server.Addr)
+	d.BloodMoonCycle = 0
+
+	now := time.Now()
+	steps := []struct {
+		after     time.Duration
+		frequency string
+		want      int
+		calls     int
+	}{
+		{0, "", telnet.DefaultBloodMoonCycle, 1},
+		{updateInterval, "5", telnet.DefaultBloodMoonCycle, 1},
+		{cycleRetryInterval, "5", 5, 2},
+		{cycleRetryInterval + updateInterval, "5", 5, 2},
+	}
+	for i, step := range steps {
+		mu.Lock()
+		frequency = step.frequency
+		mu.Unlock()
+		if got := d.bloodMoonCycle(now.Add(step.after)); got != step.want {
+			t.Errorf("step %d: cycle = %d, want %d", i, got, step.want)
+		}
+		mu.Lock()
+		if calls != step.calls {
+			t.Errorf("step %d: getgamepref called %d times, want %d", i, calls, step.calls)
+		}
+		mu.Unlock()
+	}
+}
+
+func TestReconnectResendsActivity(t *testing.T) {
+	server := startFakeServer(t)
+	setPlayers(server, 2)
+	s := &fakeSession{}
+	d := newTestBot(context.Background(), s, server.Addr)
+	for i := 0; i < 2; i++ {
+		if err := d.update(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(s.statuses); n != 1 {
+		t.Fatalf("status updated %d times before reconnect, want 1", n)
+	}
+
+	s2 := &fakeSession{}
+	d.connected(s2)
+	if err := d.update(); err != nil {
+		t.Fatal(err)
+	}
+	if got := s2.lastStatus(); got != "2 players" {
+		t.Errorf("status after reconnect = %q, want %q", got, "2 players")
+	}
+}